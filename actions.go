@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	actionMoveCard      = "move_card"
+	actionAddLabel      = "add_label"
+	actionRemoveLabel   = "remove_label"
+	actionCreateComment = "create_comment"
+	actionEditTitle     = "edit_title"
+)
+
+// recordAction logs a mutation skipped in the dry-run mode and records it to
+// the bot_action table, so it can be reviewed before turning dry-run off.
+func recordAction(log *logrus.Entry, kind, target, detail string) error {
+	log.Infof("dry-run: %s %s %q", kind, target, detail)
+	_, err := db.Exec(`INSERT INTO bot_action (created_at,kind,target,detail) VALUES (?,?,?,?)`,
+		time.Now(), kind, target, detail)
+	return err
+}
+
+func issueRef(owner, repo string, num int) string {
+	return fmt.Sprintf("%s/%s#%d", owner, repo, num)
+}
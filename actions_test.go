@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordActions(t *testing.T) {
+	old := config()
+	defer setConfig(old)
+	c := defaultConfig()
+	c.DryRun = true
+	setConfig(c)
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	// the client is nil, so any call to Github panics.
+	log := logrus.WithField("test", "dry-run")
+	issue := &github.Issue{
+		Number:        github.Int(1),
+		RepositoryURL: github.String("https://api.github.com/repos/linuxdeepin/dde"),
+	}
+	assert.Nil(t, moveCard(log, &github.ProjectCard{ID: github.Int64(101)},
+		&github.ProjectColumn{Name: github.String(c.Board.TestingColumn)}))
+	assert.Nil(t, addDelayedLabelToIssue(log, issue))
+	assert.Nil(t, createIssueComment(log, issue, "设置截止日期到 2018-12-01"))
+	issue.Labels = []github.Label{{Name: github.String(delayedLabelName)}}
+	assert.Nil(t, removeDelayedLabelForIssue(log, issue))
+
+	rows, err := db.Query(`SELECT kind,target,detail FROM bot_action ORDER BY id`)
+	assert.Nil(t, err)
+	defer rows.Close()
+	var actions [][3]string
+	for rows.Next() {
+		var a [3]string
+		assert.Nil(t, rows.Scan(&a[0], &a[1], &a[2]))
+		actions = append(actions, a)
+	}
+	assert.Nil(t, rows.Err())
+	assert.Equal(t, [][3]string{
+		{actionMoveCard, "card 101", c.Board.TestingColumn},
+		{actionAddLabel, "linuxdeepin/dde#1", delayedLabelName},
+		{actionCreateComment, "linuxdeepin/dde#1", "设置截止日期到 2018-12-01"},
+		{actionRemoveLabel, "linuxdeepin/dde#1", delayedLabelName},
+	}, actions)
+}
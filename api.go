@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiDefaultPerPage = 30
+	apiMaxPerPage     = 100
+)
+
+// apiList is the envelope of the paginated lists.
+type apiList struct {
+	Total   int         `json:"total"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Items   interface{} `json:"items"`
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+type apiCard struct {
+	ID         int64     `json:"id"`
+	ColumnID   int64     `json:"column_id"`
+	Column     string    `json:"column"`
+	ContentURL string    `json:"content_url,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type apiDeadline struct {
+	ID        int64  `json:"id"`
+	URL       string `json:"url"`
+	Ref       string `json:"ref"`
+	Repo      string `json:"repo"`
+	Date      string `json:"date"`
+	Directive string `json:"directive"`
+	Overdue   bool   `json:"overdue"`
+}
+
+type apiTeam struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(status)
+	err := json.NewEncoder(rw).Encode(v)
+	if err != nil {
+		logrus.Warning("failed to write json response: ", err)
+	}
+}
+
+func writeAPIError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, &apiError{message})
+}
+
+// checkAPIToken checks the token in the Authorization header, in the form of
+// "Bearer <token>" or "token <token>".
+func checkAPIToken(r *http.Request, tokens []string) bool {
+	auth := r.Header.Get("Authorization")
+	var token string
+	for _, prefix := range []string{"Bearer ", "token "} {
+		if strings.HasPrefix(auth, prefix) {
+			token = strings.TrimSpace(auth[len(prefix):])
+			break
+		}
+	}
+	return matchToken(token, tokens)
+}
+
+func matchToken(token string, tokens []string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// apiHandler wraps the handler with the token authentication.
+func apiHandler(handler func(rw http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		tokens := config().API.Tokens
+		if len(tokens) == 0 {
+			writeAPIError(rw, http.StatusForbidden, "the api is disabled, configure api.tokens to enable it")
+			return
+		}
+		if !checkAPIToken(r, tokens) {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="kanbanmgr"`)
+			writeAPIError(rw, http.StatusUnauthorized, "bad credentials")
+			return
+		}
+		if r.Method != "GET" {
+			writeAPIError(rw, http.StatusMethodNotAllowed, "the api is read-only")
+			return
+		}
+		handler(rw, r)
+	}
+}
+
+// feedHandler wraps the handler of a feed with the token authentication of
+// the api. The calendar clients can't set the Authorization header, so the
+// token can also be given in the token query parameter.
+func feedHandler(handler func(rw http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		tokens := config().API.Tokens
+		if len(tokens) == 0 {
+			http.Error(rw, "disabled, configure api.tokens to enable it", http.StatusForbidden)
+			return
+		}
+		if !checkAPIToken(r, tokens) && !matchToken(r.URL.Query().Get("token"), tokens) {
+			http.Error(rw, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		handler(rw, r)
+	}
+}
+
+// paginate returns the range of the page asked by the page and per_page
+// query parameters in a list of total items.
+func paginate(r *http.Request, total int) (page, perPage, start, end int) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err = strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = apiDefaultPerPage
+	}
+	if perPage > apiMaxPerPage {
+		perPage = apiMaxPerPage
+	}
+
+	start = (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end = start + perPage
+	if end > total {
+		end = total
+	}
+	return
+}
+
+func serveAPICards(rw http.ResponseWriter, r *http.Request) {
+	columns := splitValues(r.URL.Query()["column"])
+
+	cards := []*apiCard{}
+	for _, bc := range getBoardCards() {
+		if len(columns) > 0 && !matchAny(columns, bc.column) {
+			continue
+		}
+		cards = append(cards, &apiCard{
+			ID:         bc.card.GetID(),
+			ColumnID:   bc.card.GetColumnID(),
+			Column:     bc.column,
+			ContentURL: bc.card.GetContentURL(),
+			Note:       bc.card.GetNote(),
+			UpdatedAt:  bc.card.GetUpdatedAt().Time,
+		})
+	}
+
+	page, perPage, start, end := paginate(r, len(cards))
+	writeJSON(rw, http.StatusOK, &apiList{len(cards), page, perPage, cards[start:end]})
+}
+
+func newAPIDeadline(issueDeadline *IssueDeadline) (*apiDeadline, error) {
+	owner, repo, num, err := parseIssueURL(issueDeadline.url)
+	if err != nil {
+		return nil, err
+	}
+	return &apiDeadline{
+		ID:        issueDeadline.id,
+		URL:       issueDeadline.url,
+		Ref:       issueRef(owner, repo, num),
+		Repo:      owner + "/" + repo,
+		Date:      formatDate(issueDeadline.date),
+		Directive: issueDeadline.directive,
+		Overdue:   issueDeadline.isPassed(),
+	}, nil
+}
+
+func serveAPIDeadlines(rw http.ResponseWriter, r *http.Request) {
+	issueDeadlines, err := listIssueDeadlines()
+	if err != nil {
+		logrus.Warning("failed to list issue deadlines: ", err)
+		writeAPIError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	repos := splitValues(query["repo"])
+
+	deadlines := []*apiDeadline{}
+	for _, issueDeadline := range issueDeadlines {
+		deadline, err := newAPIDeadline(issueDeadline)
+		if err != nil {
+			continue
+		}
+		if len(repos) > 0 && !matchAny(repos, deadline.Repo) {
+			continue
+		}
+		if overdue, err := strconv.ParseBool(query.Get("overdue")); err == nil && overdue != deadline.Overdue {
+			continue
+		}
+		deadlines = append(deadlines, deadline)
+	}
+
+	page, perPage, start, end := paginate(r, len(deadlines))
+	writeJSON(rw, http.StatusOK, &apiList{len(deadlines), page, perPage, deadlines[start:end]})
+}
+
+func serveAPITeams(rw http.ResponseWriter, r *http.Request) {
+	teamsLock.Lock()
+	teams := []*apiTeam{}
+	for _, t := range metaTeams {
+		team := &apiTeam{
+			ID:      t.GetID(),
+			Name:    t.GetName(),
+			Members: []string{},
+		}
+		for _, m := range t.Members {
+			team.Members = append(team.Members, m.GetLogin())
+		}
+		teams = append(teams, team)
+	}
+	teamsLock.Unlock()
+
+	page, perPage, start, end := paginate(r, len(teams))
+	writeJSON(rw, http.StatusOK, &apiList{len(teams), page, perPage, teams[start:end]})
+}
+
+// serveAPIOverdue serves the open issues on the board which are overdue,
+// filtered by the assignee, repo and column query parameters.
+func serveAPIOverdue(rw http.ResponseWriter, r *http.Request) {
+	issues, err := getTrackedIssues()
+	if err != nil {
+		logrus.Warning("failed to get tracked issues: ", err)
+		writeAPIError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now()
+	overdue := []*trackedIssue{}
+	for _, issue := range parseIssueFilter(r.URL.Query()).filter(issues) {
+		if issue.isOverdueAt(now) {
+			overdue = append(overdue, issue)
+		}
+	}
+
+	page, perPage, start, end := paginate(r, len(overdue))
+	writeJSON(rw, http.StatusOK, &apiList{len(overdue), page, perPage, overdue[start:end]})
+}
+
+func registerAPIHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/cards", apiHandler(serveAPICards))
+	mux.HandleFunc("/api/v1/deadlines", apiHandler(serveAPIDeadlines))
+	mux.HandleFunc("/api/v1/teams", apiHandler(serveAPITeams))
+	mux.HandleFunc("/api/v1/overdue", apiHandler(serveAPIOverdue))
+	mux.HandleFunc("/api/v1/metrics", apiHandler(serveAPIMetrics))
+	mux.HandleFunc("/api/v1/flow/cfd", apiHandler(serveFlow(chartCFD, "json")))
+	mux.HandleFunc("/api/v1/flow/burndown", apiHandler(serveFlow(chartBurndown, "json")))
+	mux.HandleFunc("/api/", apiHandler(func(rw http.ResponseWriter, r *http.Request) {
+		writeAPIError(rw, http.StatusNotFound, "not found")
+	}))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIAuth(t *testing.T) {
+	old := config()
+	defer setConfig(old)
+
+	handler := apiHandler(serveAPITeams)
+	get := func(auth string) int {
+		r := httptest.NewRequest("GET", "/api/v1/teams", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, r)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("Bearer 0123456789abcdef"))
+
+	c := defaultConfig()
+	c.API.Tokens = []string{"0123456789abcdef"}
+	setConfig(c)
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer 0123456789abcdeg"))
+	assert.Equal(t, http.StatusOK, get("Bearer 0123456789abcdef"))
+	assert.Equal(t, http.StatusOK, get("token 0123456789abcdef"))
+}
+
+func TestAPIPagination(t *testing.T) {
+	oldTeams := metaTeams
+	defer func() { metaTeams = oldTeams }()
+
+	metaTeams = nil
+	for i := int64(1); i <= 5; i++ {
+		metaTeams = append(metaTeams, &team{&github.Team{ID: github.Int64(i)}, nil})
+	}
+
+	list := func(query string) (*apiList, []*apiTeam) {
+		rw := httptest.NewRecorder()
+		serveAPITeams(rw, httptest.NewRequest("GET", "/api/v1/teams?"+query, nil))
+		var teams []*apiTeam
+		list := &apiList{Items: &teams}
+		assert.Nil(t, json.NewDecoder(rw.Body).Decode(list))
+		return list, teams
+	}
+
+	l, teams := list("per_page=2&page=2")
+	assert.Equal(t, 5, l.Total)
+	assert.Equal(t, 2, l.Page)
+	assert.Len(t, teams, 2)
+	assert.Equal(t, int64(3), teams[0].ID)
+
+	_, teams = list("per_page=2&page=3")
+	assert.Len(t, teams, 1)
+
+	_, teams = list("per_page=2&page=9")
+	assert.Len(t, teams, 0)
+
+	l, teams = list("")
+	assert.Equal(t, apiDefaultPerPage, l.PerPage)
+	assert.Len(t, teams, 5)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backfillDeadlines fetches the issue of every card on the board and syncs
+// the deadline in its title, which catches up the titles edited while the
+// bot was down. At most concurrency issues are processed at the same time,
+// each of them in the issue executor, so it doesn't race with the webhooks.
+func backfillDeadlines(log *logrus.Entry, concurrency int) error {
+	urls := getCardContentURLs()
+	log.Infof("backfill the deadlines of %d issues", len(urls))
+
+	queue := make(chan string)
+	var mu sync.Mutex
+	failed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for issueURL := range queue {
+				err := backfillIssueDeadline(log, issueURL)
+				if err != nil {
+					log.Warningf("failed to backfill the deadline of %s: %v", issueURL, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, issueURL := range urls {
+		queue <- issueURL
+	}
+	close(queue)
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("failed to backfill %d of %d issues", failed, len(urls))
+	}
+	return nil
+}
+
+// backfillIssueDeadline syncs the deadline of the issue, the issue is
+// always fetched since the cached title may be outdated. It's fetched in the
+// issue executor, so a webhook handled meanwhile isn't undone by the older
+// title. The issues never given a deadline are skipped.
+func backfillIssueDeadline(log *logrus.Entry, issueURL string) error {
+	return issueExecutor.Run(issueURL, func() error {
+		issue, err := fetchIssue(issueURL)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().In(config().issueLocation(issue))
+		_, _, err = getDeadlineFromTitle(now, issue.GetTitle())
+		if err != nil && !hasDelayedLabel(issue) {
+			issueDeadline, err := getIssueDeadline(issue.GetID())
+			if err != nil {
+				return err
+			}
+			if issueDeadline == nil {
+				return nil
+			}
+		}
+		return processIssueDeadline(log, issue)
+	})
+}
+
+// runBackfill implements the backfill subcommand, which backfills the
+// deadlines once without starting the bot.
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	registerConfigFlag(flags)
+	dryRun := flags.Bool("dry-run", false, "log and record the changes to Github instead of doing them")
+	concurrency := flags.Int("concurrency", 0, "the issues processed at the same time, defaults to deadlines.backfill_concurrency")
+	flags.Parse(args)
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		c.DryRun = true
+	}
+	if *concurrency > 0 {
+		c.Deadlines.BackfillConcurrency = *concurrency
+	}
+	err = c.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	setConfig(c)
+	err = setupLogging(c)
+	if err != nil {
+		return err
+	}
+
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = initGithubClient()
+	if err != nil {
+		return err
+	}
+	err = PrepareKanbanMetadata()
+	if err != nil {
+		return err
+	}
+	return backfillDeadlines(logrus.WithField("job", "deadline-backfill"), c.Deadlines.BackfillConcurrency)
+}
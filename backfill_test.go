@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillDeadlines(t *testing.T) {
+	const (
+		repoURL     = "https://api.github.com/repos/linuxdeepin/dde"
+		urlEdited   = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+		urlCanceled = "https://api.github.com/repos/linuxdeepin/dde/issues/2"
+		urlNone     = "https://api.github.com/repos/linuxdeepin/dde/issues/3"
+	)
+	var out bytes.Buffer
+	board := &fakeBoard{
+		out:      &out,
+		Projects: []*fakeProject{{ID: 1, Name: config().Board.Project}},
+		Columns: []*fakeColumn{
+			{ID: 11, ProjectID: 1, Name: config().Board.DevelopingColumn},
+			{ID: 12, ProjectID: 1, Name: config().Board.TestingColumn},
+		},
+		Cards: []*fakeCard{
+			{ID: 101, ColumnID: 11, ContentURL: urlEdited},
+			{ID: 102, ColumnID: 12, ContentURL: urlCanceled},
+			{ID: 103, ColumnID: 12, ContentURL: urlNone},
+		},
+		Issues: []*github.Issue{
+			{ID: github.Int64(1001), Number: github.Int(1), URL: github.String(urlEdited),
+				RepositoryURL: github.String(repoURL), Title: github.String("<2018-12-01> fix the crash")},
+			{ID: github.Int64(1002), Number: github.Int(2), URL: github.String(urlCanceled),
+				RepositoryURL: github.String(repoURL), Title: github.String("fix the typo")},
+			{ID: github.Int64(1003), Number: github.Int(3), URL: github.String(urlNone),
+				RepositoryURL: github.String(repoURL), Title: github.String("update the docs")},
+		},
+	}
+	var stop func()
+	client, stop = board.newClient()
+	defer stop()
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	assert.Nil(t, PrepareKanbanMetadata())
+	// the deadline removed from the title while the bot was down.
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1002, date: time.Now(), url: urlCanceled, directive: "3"}))
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &logs
+	assert.Nil(t, backfillDeadlines(logger.WithField("job", "deadline-backfill"), 2))
+
+	issueDeadline, err := getIssueDeadlineByURL(urlEdited)
+	assert.Nil(t, err)
+	assert.Equal(t, "<2018-12-01>", issueDeadline.directive)
+	issueDeadline, err = getIssueDeadlineByURL(urlCanceled)
+	assert.Nil(t, err)
+	assert.Nil(t, issueDeadline)
+	assert.Contains(t, out.String(), "comment on linuxdeepin/dde#1: 设置截止日期到 2018-12-01")
+	assert.Contains(t, out.String(), `add label "delayed" to linuxdeepin/dde#1`)
+	// the issue never given a deadline is skipped.
+	assert.Contains(t, logs.String(), "issue=2")
+	assert.NotContains(t, logs.String(), "issue=3")
+
+	// nothing changes when backfilled again.
+	out.Reset()
+	assert.Nil(t, backfillDeadlines(logrus.WithField("job", "deadline-backfill"), 2))
+	assert.NotContains(t, out.String(), "comment on")
+}
+
+func TestBackfillDeadlineTimezone(t *testing.T) {
+	const (
+		repoURL  = "https://api.github.com/repos/linuxdeepin/dde"
+		issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	)
+	old := config()
+	defer setConfig(old)
+	c := defaultConfig()
+	c.Board.AssigneeTimezones = map[string]string{"bob": "America/Los_Angeles"}
+	setConfig(c)
+
+	var out bytes.Buffer
+	issue := &github.Issue{ID: github.Int64(1001), Number: github.Int(1), URL: github.String(issueURL),
+		RepositoryURL: github.String(repoURL), Title: github.String("<2018-12-01> fix the crash"),
+		Assignees: []*github.User{{Login: github.String("bob")}}}
+	board := &fakeBoard{
+		out:      &out,
+		Projects: []*fakeProject{{ID: 1, Name: c.Board.Project}},
+		Columns:  []*fakeColumn{{ID: 11, ProjectID: 1, Name: c.Board.DevelopingColumn}},
+		Cards:    []*fakeCard{{ID: 101, ColumnID: 11, ContentURL: issueURL}},
+		Issues:   []*github.Issue{issue},
+	}
+	var stop func()
+	client, stop = board.newClient()
+	defer stop()
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	assert.Nil(t, PrepareKanbanMetadata())
+
+	log := logrus.WithField("job", "deadline-backfill")
+	assert.Nil(t, backfillDeadlines(log, 1))
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "America/Los_Angeles", issueDeadline.timezone)
+
+	// reassigned while the bot was down, the day now ends in the board
+	// timezone, and the deadline isn't set again.
+	issue.Assignees = []*github.User{{Login: github.String("alice")}}
+	out.Reset()
+	assert.Nil(t, backfillDeadlines(log, 1))
+	issueDeadline, err = getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "", issueDeadline.timezone)
+	assert.Equal(t, "2018-12-01", formatDate(issueDeadline.date))
+	assert.NotContains(t, out.String(), "comment on")
+}
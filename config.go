@@ -1,79 +1,446 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
 )
 
-var (
-	// OrgName is the organization name to be working on.
-	OrgName = "linuxdeepin"
-	// WebhookSecret is the webhook secret set in the Github Apps installation page.
-	WebhookSecret = ""
-	//TargetProject is the project that this app will try to manage.
-	TargetProject = "deepin 系统发布看板"
-	// TestingColumnName is the name of the column intend to be used as in the testing phase.
-	TestingColumnName = "测试"
-	// DevelopingColumnName is the name of the column intend to be used as in the developing phase.
-	DevelopingColumnName = "开发"
-	// QATeamName is the name of the testers' team.
-	QATeamName = "QA Team"
-	// DevTeamName is the name of the devs' team.
-	DevTeamName = "Developer Team"
-	// PEMFilePath is path to the pem file.
-	PEMFilePath = ""
-	// AppInstallationID is the ID of the installation,
-	// which will show in the address bar if you're trying to configure a github app.
-	AppInstallationID int
+// Config is the configuration of the app. It's loaded from the config file,
+// then the environment variables override the values in the file.
+type Config struct {
+	// Org is the organization name to be working on.
+	Org       string          `yaml:"org"`
+	Github    githubConfig    `yaml:"github"`
+	Board     boardConfig     `yaml:"board"`
+	Teams     teamsConfig     `yaml:"teams"`
+	Server    serverConfig    `yaml:"server"`
+	Database  databaseConfig  `yaml:"database"`
+	Jobs      jobsConfig      `yaml:"jobs"`
+	Deadlines deadlinesConfig `yaml:"deadlines"`
+	Reports   reportsConfig   `yaml:"reports"`
+	API       apiConfig       `yaml:"api"`
+	Log       logConfig       `yaml:"log"`
+	// DryRun makes the app log and record the changes to Github instead of doing them.
+	DryRun bool `yaml:"dry_run"`
+}
+
+type githubConfig struct {
 	// AppID is the ID of the app
-	AppID = 20288
-	// ServePort is the port will be used.
-	ServePort = 7788
-)
+	AppID int `yaml:"app_id"`
+	// InstallationID is the ID of the installation,
+	// which will show in the address bar if you're trying to configure a github app.
+	InstallationID int `yaml:"installation_id"`
+	// PEMFile is path to the pem file.
+	PEMFile string `yaml:"pem_file"`
+	// WebhookSecret is the webhook secret set in the Github Apps installation page.
+	WebhookSecret string `yaml:"webhook_secret"`
+	// RequestTimeout is the timeout in seconds of every API request.
+	RequestTimeout int `yaml:"request_timeout"`
+	// RateLimitReserve is the remaining rate limit under which the low
+	// priority jobs wait for the rate limit to reset.
+	RateLimitReserve int `yaml:"rate_limit_reserve"`
+}
+
+type boardConfig struct {
+	// Project is the project that this app will try to manage.
+	Project string `yaml:"project"`
+	// DevelopingColumn is the name of the column intend to be used as in the developing phase.
+	DevelopingColumn string `yaml:"developing_column"`
+	// TestingColumn is the name of the column intend to be used as in the testing phase.
+	TestingColumn string `yaml:"testing_column"`
+	// Timezone is the IANA timezone used to resolve the deadlines.
+	Timezone string `yaml:"timezone"`
+	// AssigneeTimezones overrides the timezone for the issues assigned to the users.
+	AssigneeTimezones map[string]string `yaml:"assignee_timezones"`
+	// CheckTime is the time of day in the board timezone to check the deadlines.
+	CheckTime string `yaml:"check_time"`
+}
+
+type teamsConfig struct {
+	// QA is the name of the testers' team.
+	QA string `yaml:"qa"`
+	// Dev is the name of the devs' team.
+	Dev string `yaml:"dev"`
+}
+
+// jobsConfig is the cron expressions of the background jobs, which are in the
+// board timezone unless prefixed with CRON_TZ=. Empty means disabled.
+type jobsConfig struct {
+	// DelayCheck defaults to daily at board.check_time.
+	DelayCheck      string `yaml:"delay_check"`
+	Reminders       string `yaml:"reminders"`
+	Reconcile       string `yaml:"reconcile"`
+	TeamRefresh     string `yaml:"team_refresh"`
+	PruneDeliveries string `yaml:"prune_deliveries"`
+	DailyReport     string `yaml:"daily_report"`
+	WeeklyReport    string `yaml:"weekly_report"`
+	FlowSnapshot    string `yaml:"flow_snapshot"`
+	// DeadlineBackfill also runs when the bot starts.
+	DeadlineBackfill string `yaml:"deadline_backfill"`
+}
+
+type deadlinesConfig struct {
+	// BackfillConcurrency is the number of the issues processed at the same
+	// time by the backfill.
+	BackfillConcurrency int `yaml:"backfill_concurrency"`
+}
+
+type reportsConfig struct {
+	// TrackingIssue is the issue in the form of owner/repo#num to post the digests to.
+	TrackingIssue string `yaml:"tracking_issue"`
+	// OutputDir is the directory to write the digests to.
+	OutputDir string `yaml:"output_dir"`
+	// Format is the format of the digest files, markdown or html.
+	Format string `yaml:"format"`
+	// StuckDays is the days after which a card staying in a column is stuck.
+	StuckDays int `yaml:"stuck_days"`
+}
+
+type apiConfig struct {
+	// Tokens are the bearer tokens accepted by the REST API, the API is
+	// disabled if there's none.
+	Tokens []string `yaml:"tokens"`
+}
+
+type logConfig struct {
+	// Level is one of the logrus levels, e.g. debug, info and warning.
+	Level string `yaml:"level"`
+	// Format is text or json.
+	Format string `yaml:"format"`
+}
+
+type databaseConfig struct {
+	// DSN is a postgres:// URL, or the path of the SQLite file otherwise.
+	DSN string `yaml:"dsn"`
+}
+
+type serverConfig struct {
+	// Port is the port will be used.
+	Port int `yaml:"port"`
+	// ShutdownTimeout is how long in seconds to wait for the in-flight work
+	// when shutting down.
+	ShutdownTimeout int `yaml:"shutdown_timeout"`
+	// LeaseDuration is how long in seconds the leader holds the lease
+	// without renewing it, another replica takes over after it expires.
+	LeaseDuration int `yaml:"lease_duration"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Org: "linuxdeepin",
+		Github: githubConfig{
+			AppID:            20288,
+			RequestTimeout:   30,
+			RateLimitReserve: 500,
+		},
+		Board: boardConfig{
+			Project:          "deepin 系统发布看板",
+			DevelopingColumn: "开发",
+			TestingColumn:    "测试",
+			Timezone:         "Asia/Shanghai",
+			CheckTime:        "1:00",
+		},
+		Teams: teamsConfig{
+			QA:  "QA Team",
+			Dev: "Developer Team",
+		},
+		Server: serverConfig{
+			Port:            7788,
+			ShutdownTimeout: 30,
+			LeaseDuration:   30,
+		},
+		Database: databaseConfig{
+			DSN: "kanbanmgr.db",
+		},
+		Log: logConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Jobs: jobsConfig{
+			Reconcile:        "0 */6 * * *",
+			TeamRefresh:      "30 0 * * *",
+			PruneDeliveries:  "0 2 * * *",
+			FlowSnapshot:     "55 23 * * *",
+			DeadlineBackfill: "45 0 * * *",
+		},
+		Deadlines: deadlinesConfig{
+			BackfillConcurrency: 4,
+		},
+		Reports: reportsConfig{
+			Format:    "markdown",
+			StuckDays: 7,
+		},
+	}
+}
+
+// the environment variables used before the config file is introduced,
+// they are kept for compatibility.
+var envOverrides = []struct {
+	name  string
+	apply func(c *Config, value string) error
+}{
+	{"ORG_NAME", func(c *Config, v string) error { c.Org = v; return nil }},
+	{"WEBHOOK_SECRET", func(c *Config, v string) error { c.Github.WebhookSecret = v; return nil }},
+	{"PROJECT_NAME", func(c *Config, v string) error { c.Board.Project = v; return nil }},
+	{"TESTING_COL_NAME", func(c *Config, v string) error { c.Board.TestingColumn = v; return nil }},
+	{"DEVELOPING_COL_NAME", func(c *Config, v string) error { c.Board.DevelopingColumn = v; return nil }},
+	{"QA_TEAM_NAME", func(c *Config, v string) error { c.Teams.QA = v; return nil }},
+	{"DEV_TEAM_NAME", func(c *Config, v string) error { c.Teams.Dev = v; return nil }},
+	{"PEM_FILE", func(c *Config, v string) error { c.Github.PEMFile = v; return nil }},
+	{"APP_INSTALLATION_ID", func(c *Config, v string) error { return parseInt(v, &c.Github.InstallationID) }},
+	{"APP_ID", func(c *Config, v string) error { return parseInt(v, &c.Github.AppID) }},
+	{"SERVE_PORT", func(c *Config, v string) error { return parseInt(v, &c.Server.Port) }},
+	{"DRY_RUN", func(c *Config, v string) error { return parseBool(v, &c.DryRun) }},
+	{"TIMEZONE", func(c *Config, v string) error { c.Board.Timezone = v; return nil }},
+	{"API_TOKENS", func(c *Config, v string) error { c.API.Tokens = splitValues([]string{v}); return nil }},
+	{"LOG_LEVEL", func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"DATABASE_URL", func(c *Config, v string) error { c.Database.DSN = v; return nil }},
+	{"LOG_FORMAT", func(c *Config, v string) error { c.Log.Format = v; return nil }},
+}
+
+func parseInt(str string, value *int) (err error) {
+	*value, err = strconv.Atoi(str)
+	return
+}
+
+func parseBool(str string, value *bool) (err error) {
+	*value, err = strconv.ParseBool(str)
+	return
+}
+
+func (c *Config) applyEnv() error {
+	for _, env := range envOverrides {
+		value, found := os.LookupEnv(env.name)
+		if !found {
+			continue
+		}
+		err := env.apply(c, value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q of %s: %v", value, env.name, err)
+		}
+	}
+	return nil
+}
+
+const defaultConfigFile = "kanbanmgr.yml"
+
+// configFile is the path of the config file, set by the -config flag.
+var configFile = defaultConfigFile
 
 func init() {
-	orgname, found := os.LookupEnv("ORG_NAME")
-	if found {
-		OrgName = orgname
+	if filename, found := os.LookupEnv("KANBANMGR_CONFIG"); found {
+		configFile = filename
+	}
+	setConfig(defaultConfig())
+}
+
+func registerConfigFlag(flags *flag.FlagSet) {
+	flags.StringVar(&configFile, "config", configFile, "path to the config file")
+}
+
+// loadConfig loads the config file and applies the environment variables,
+// the default config file is allowed to be missing.
+func loadConfig(filename string) (*Config, error) {
+	c := defaultConfig()
+
+	data, err := ioutil.ReadFile(filename)
+	switch {
+	case os.IsNotExist(err) && filename == defaultConfigFile:
+	case err != nil:
+		return nil, err
+	default:
+		err = yaml.UnmarshalStrict(data, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %q: %v", filename, err)
+		}
 	}
-	webhooksecret, found := os.LookupEnv("WEBHOOK_SECRET")
-	if found {
-		WebhookSecret = webhooksecret
+
+	err = c.applyEnv()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the whole config, all the problems found are reported.
+func (c *Config) Validate() error {
+	problems := c.validateBoard()
+	problems = append(problems, c.validateJobs()...)
+	problems = append(problems, c.validateGithub()...)
+	return joinProblems(problems)
+}
+
+func (c *Config) validateBoard() []string {
+	var problems []string
+	if c.Org == "" {
+		problems = append(problems, "org is required")
+	}
+	if c.Board.Project == "" {
+		problems = append(problems, "board.project is required")
+	}
+	if c.Board.DevelopingColumn == "" {
+		problems = append(problems, "board.developing_column is required")
+	}
+	if c.Board.TestingColumn == "" {
+		problems = append(problems, "board.testing_column is required")
+	}
+	if c.Board.DevelopingColumn != "" && c.Board.DevelopingColumn == c.Board.TestingColumn {
+		problems = append(problems, "board.developing_column and board.testing_column must be different")
+	}
+	if _, err := loadLocation(c.Board.Timezone); err != nil {
+		problems = append(problems, fmt.Sprintf("board.timezone: %v", err))
+	}
+	for login, name := range c.Board.AssigneeTimezones {
+		if _, err := loadLocation(name); err != nil {
+			problems = append(problems, fmt.Sprintf("board.assignee_timezones.%s: %v", login, err))
+		}
 	}
-	targetproject, found := os.LookupEnv("PROJECT_NAME")
-	if found {
-		TargetProject = targetproject
+	if _, err := time.Parse(layoutClock, c.Board.CheckTime); err != nil {
+		problems = append(problems, fmt.Sprintf("board.check_time %q is not in the format of 15:04", c.Board.CheckTime))
 	}
-	testingcolumnname, found := os.LookupEnv("TESTING_COL_NAME")
-	if found {
-		TestingColumnName = testingcolumnname
+	if c.Teams.QA == "" {
+		problems = append(problems, "teams.qa is required")
 	}
-	developingcolumnname, found := os.LookupEnv("DEVELOPING_COL_NAME")
-	if found {
-		DevelopingColumnName = developingcolumnname
+	if c.Teams.Dev == "" {
+		problems = append(problems, "teams.dev is required")
 	}
-	qateamname, found := os.LookupEnv("QA_TEAM_NAME")
-	if found {
-		QATeamName = qateamname
+	if c.Reports.TrackingIssue != "" {
+		if _, _, _, err := parseIssueRef(c.Reports.TrackingIssue); err != nil {
+			problems = append(problems, fmt.Sprintf("reports.tracking_issue: %v", err))
+		}
 	}
-	devteamname, found := os.LookupEnv("DEV_TEAM_NAME")
-	if found {
-		DevTeamName = devteamname
+	if c.Reports.Format != "markdown" && c.Reports.Format != "html" {
+		problems = append(problems, fmt.Sprintf("reports.format %q is neither markdown nor html", c.Reports.Format))
+	}
+	if c.Reports.StuckDays <= 0 {
+		problems = append(problems, "reports.stuck_days must be positive")
+	}
+	for i, token := range c.API.Tokens {
+		if len(token) < 16 {
+			problems = append(problems, fmt.Sprintf("api.tokens[%d] is too short, use at least 16 characters", i))
+		}
+	}
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port %d is out of range", c.Server.Port))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problems = append(problems, "server.shutdown_timeout must be positive")
+	}
+	if c.Server.LeaseDuration < 3 {
+		problems = append(problems, "server.lease_duration must be at least 3")
+	}
+	if c.Deadlines.BackfillConcurrency <= 0 {
+		problems = append(problems, "deadlines.backfill_concurrency must be positive")
+	}
+	if c.Database.DSN == "" {
+		problems = append(problems, "database.dsn is required")
+	}
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %v", err))
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		problems = append(problems, fmt.Sprintf("log.format %q is neither text nor json", c.Log.Format))
+	}
+	return problems
+}
+
+func (c *Config) validateGithub() []string {
+	var problems []string
+	if c.Github.AppID <= 0 {
+		problems = append(problems, "github.app_id is required")
 	}
-	pemfilepath, found := os.LookupEnv("PEM_FILE")
-	if found {
-		PEMFilePath = pemfilepath
+	if c.Github.InstallationID <= 0 {
+		problems = append(problems, "github.installation_id is required")
 	}
-	appinstallationid, found := os.LookupEnv("APP_INSTALLATION_ID")
-	if found {
-		AppInstallationID, _ = strconv.Atoi(appinstallationid)
+	if c.Github.PEMFile == "" {
+		problems = append(problems, "github.pem_file is required")
+	} else if _, err := os.Stat(c.Github.PEMFile); err != nil {
+		problems = append(problems, fmt.Sprintf("github.pem_file: %v", err))
 	}
-	appID, found := os.LookupEnv("APP_ID")
-	if found {
-		AppID, _ = strconv.Atoi(appID)
+	if c.Github.RequestTimeout <= 0 {
+		problems = append(problems, "github.request_timeout must be positive")
 	}
-	serveport, found := os.LookupEnv("SERVE_PORT")
-	if found {
-		ServePort, _ = strconv.Atoi(serveport)
+	if c.Github.RateLimitReserve < 0 {
+		problems = append(problems, "github.rate_limit_reserve must not be negative")
+	}
+	return problems
+}
+
+func joinProblems(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+const maskedSecret = "******"
+
+// masked returns a copy of the config with the secrets masked, so it's safe
+// to be printed.
+func (c *Config) masked() *Config {
+	ret := *c
+	if ret.Github.WebhookSecret != "" {
+		ret.Github.WebhookSecret = maskedSecret
+	}
+	ret.API.Tokens = nil
+	for range c.API.Tokens {
+		ret.API.Tokens = append(ret.API.Tokens, maskedSecret)
+	}
+	if u, err := url.Parse(c.Database.DSN); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.User(u.User.Username())
+			ret.Database.DSN = strings.Replace(u.String(), "@", ":"+maskedSecret+"@", 1)
+		}
+	}
+	return &ret
+}
+
+var currentConfig atomic.Value
+
+// config returns the configuration in use.
+func config() *Config {
+	return currentConfig.Load().(*Config)
+}
+
+func setConfig(c *Config) {
+	currentConfig.Store(c)
+}
+
+// runConfig implements the config subcommand, `config check` validates the
+// config and prints the effective configuration.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: %s config check [-config kanbanmgr.yml]", os.Args[0])
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	registerConfigFlag(flags)
+	flags.Parse(args[1:])
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c.masked())
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+
+	err = c.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
 	}
+	return nil
 }
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// cardTransition is a move of a card between columns, From is empty when the
+// card is created and To is empty when it's deleted.
+type cardTransition struct {
+	CardID   int64
+	IssueURL string
+	From     string
+	To       string
+	MovedAt  time.Time
+}
+
+func addCardTransition(t *cardTransition) error {
+	_, err := db.Exec(`INSERT INTO card_transition (card_id,issue_url,from_column,to_column,moved_at) VALUES (?,?,?,?,?)`,
+		t.CardID, t.IssueURL, t.From, t.To, t.MovedAt)
+	return err
+}
+
+// setCardTransitionsIssue sets the issue of the transitions recorded while
+// the card was a note.
+func setCardTransitionsIssue(cardID int64, issueURL string) error {
+	_, err := db.Exec(`UPDATE card_transition SET issue_url = ? WHERE card_id = ? AND issue_url = ''`,
+		issueURL, cardID)
+	return err
+}
+
+func getLastCardTransition(cardID int64) (*cardTransition, error) {
+	t := &cardTransition{CardID: cardID}
+	err := db.QueryRow(`SELECT issue_url,from_column,to_column,moved_at FROM card_transition
+		WHERE card_id = ? ORDER BY moved_at DESC, id DESC LIMIT 1`, cardID).
+		Scan(&t.IssueURL, &t.From, &t.To, &t.MovedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func listCardTransitions() ([]*cardTransition, error) {
+	rows, err := db.Query(`SELECT card_id,issue_url,from_column,to_column,moved_at FROM card_transition
+		ORDER BY moved_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []*cardTransition
+	for rows.Next() {
+		t := &cardTransition{}
+		err = rows.Scan(&t.CardID, &t.IssueURL, &t.From, &t.To, &t.MovedAt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
+
+// getColumnName returns the name of the column on the board, ok is false if
+// the column isn't on the board.
+func getColumnName(columnID int64) (name string, ok bool) {
+	cardsLock.Lock()
+	defer cardsLock.Unlock()
+
+	for _, col := range metaColumns {
+		if col.GetID() == columnID {
+			return col.GetName(), true
+		}
+	}
+	return "", false
+}
+
+// recordCardEvent records the column transition of the card event, the
+// column the card is moved from is the destination of its last transition.
+// A note converted to an issue takes its transitions to the issue.
+func recordCardEvent(action string, card *github.ProjectCard) error {
+	column, ok := getColumnName(card.GetColumnID())
+	if !ok {
+		// the card is on another project.
+		return nil
+	}
+
+	t := &cardTransition{
+		CardID:   card.GetID(),
+		IssueURL: card.GetContentURL(),
+		MovedAt:  card.GetUpdatedAt().Time,
+	}
+	if t.MovedAt.IsZero() {
+		t.MovedAt = time.Now()
+	}
+
+	switch action {
+	case "converted":
+		return setCardTransitionsIssue(card.GetID(), card.GetContentURL())
+	case "created":
+		t.To = column
+	case "deleted":
+		t.From = column
+	case "moved":
+		last, err := getLastCardTransition(card.GetID())
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			t.From = last.To
+		}
+		t.To = column
+		if t.From == t.To {
+			// reordered in the same column.
+			return nil
+		}
+	default:
+		return nil
+	}
+	return addCardTransition(t)
+}
+
+// cardColumnSince returns the time the card is moved into its column, or the
+// last update time of the card if the move isn't recorded.
+func cardColumnSince(card *github.ProjectCard, column string) time.Time {
+	last, err := getLastCardTransition(card.GetID())
+	if err != nil {
+		logrus.Warningf("failed to get the last transition of card %d: %v", card.GetID(), err)
+	}
+	if last != nil && last.To == column {
+		return last.MovedAt
+	}
+	return card.GetUpdatedAt().Time
+}
+
+// issueFlow is how an issue flows through the board. The cycle time starts
+// when the issue enters the developing column and the lead time when it's
+// added to the board, both end when it leaves the testing column for a
+// column out of the target ones.
+type issueFlow struct {
+	URL        string
+	Ref        string
+	Repo       string
+	Added      time.Time
+	Started    time.Time
+	Done       time.Time
+	Developing time.Duration
+	Testing    time.Duration
+}
+
+func (f *issueFlow) isDone() bool {
+	return !f.Done.IsZero()
+}
+
+func (f *issueFlow) cycleTime() time.Duration {
+	if !f.isDone() || f.Started.IsZero() {
+		return 0
+	}
+	return f.Done.Sub(f.Started)
+}
+
+func (f *issueFlow) leadTime() time.Duration {
+	if !f.isDone() {
+		return 0
+	}
+	return f.Done.Sub(f.Added)
+}
+
+// buildIssueFlows replays the transitions in time order, the issues still in
+// the target columns count their time there until now.
+func buildIssueFlows(transitions []*cardTransition, board boardConfig, now time.Time) []*issueFlow {
+	type state struct {
+		column string
+		since  time.Time
+	}
+
+	var flows []*issueFlow
+	byURL := make(map[string]*issueFlow)
+	states := make(map[string]*state)
+
+	spend := func(flow *issueFlow, s *state, until time.Time) {
+		switch s.column {
+		case board.DevelopingColumn:
+			flow.Developing += until.Sub(s.since)
+		case board.TestingColumn:
+			flow.Testing += until.Sub(s.since)
+		}
+	}
+
+	for _, t := range transitions {
+		if t.IssueURL == "" {
+			continue
+		}
+		flow := byURL[t.IssueURL]
+		if flow == nil {
+			owner, repo, num, err := parseIssueURL(t.IssueURL)
+			if err != nil {
+				continue
+			}
+			flow = &issueFlow{
+				URL:   t.IssueURL,
+				Ref:   issueRef(owner, repo, num),
+				Repo:  owner + "/" + repo,
+				Added: t.MovedAt,
+			}
+			byURL[t.IssueURL] = flow
+			states[t.IssueURL] = &state{}
+			flows = append(flows, flow)
+		}
+
+		s := states[t.IssueURL]
+		spend(flow, s, t.MovedAt)
+		s.column, s.since = t.To, t.MovedAt
+
+		switch t.To {
+		case board.DevelopingColumn:
+			if flow.Started.IsZero() {
+				flow.Started = t.MovedAt
+			}
+			flow.Done = time.Time{}
+		case board.TestingColumn:
+			flow.Done = time.Time{}
+		default:
+			if t.From == board.TestingColumn {
+				flow.Done = t.MovedAt
+			}
+		}
+	}
+
+	for _, flow := range flows {
+		spend(flow, states[flow.URL], now)
+	}
+	return flows
+}
+
+const (
+	metricsByIssue    = "issue"
+	metricsByAssignee = "assignee"
+	metricsByRepo     = "repo"
+)
+
+// flowMetrics is the average times in hours of the issues done in a group.
+type flowMetrics struct {
+	Key        string  `json:"key"`
+	Done       int     `json:"done"`
+	CycleTime  float64 `json:"cycle_time_hours"`
+	LeadTime   float64 `json:"lead_time_hours"`
+	InTesting  float64 `json:"in_testing_hours"`
+	InProgress int     `json:"in_progress"`
+}
+
+// aggregateFlows groups the flows by the keys, the issues done before since
+// are skipped.
+func aggregateFlows(flows []*issueFlow, since time.Time, keys func(*issueFlow) []string) []*flowMetrics {
+	type totals struct {
+		cycle, lead, testing time.Duration
+	}
+
+	var ret []*flowMetrics
+	groups := make(map[string]*flowMetrics)
+	sums := make(map[string]*totals)
+
+	for _, flow := range flows {
+		if flow.isDone() && flow.Done.Before(since) {
+			continue
+		}
+		for _, key := range keys(flow) {
+			m := groups[key]
+			if m == nil {
+				m = &flowMetrics{Key: key}
+				groups[key] = m
+				sums[key] = &totals{}
+				ret = append(ret, m)
+			}
+			if !flow.isDone() {
+				m.InProgress++
+				continue
+			}
+			m.Done++
+			sum := sums[key]
+			sum.cycle += flow.cycleTime()
+			sum.lead += flow.leadTime()
+			sum.testing += flow.Testing
+		}
+	}
+
+	for _, m := range ret {
+		if m.Done == 0 {
+			continue
+		}
+		sum := sums[m.Key]
+		m.CycleTime = sum.cycle.Hours() / float64(m.Done)
+		m.LeadTime = sum.lead.Hours() / float64(m.Done)
+		m.InTesting = sum.testing.Hours() / float64(m.Done)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+// getFlowMetrics computes the metrics grouped by the issue, assignee or repo.
+// Grouping by the assignee fetches the issues not in the cache.
+func getFlowMetrics(by string, since time.Time, now time.Time) ([]*flowMetrics, error) {
+	transitions, err := listCardTransitions()
+	if err != nil {
+		return nil, err
+	}
+	flows := buildIssueFlows(transitions, config().Board, now)
+
+	var keys func(*issueFlow) []string
+	switch by {
+	case metricsByIssue, "":
+		keys = func(f *issueFlow) []string { return []string{f.Ref} }
+	case metricsByRepo:
+		keys = func(f *issueFlow) []string { return []string{f.Repo} }
+	case metricsByAssignee:
+		keys = func(f *issueFlow) []string {
+			issue, err := getIssueByURL(f.URL)
+			if err != nil {
+				logrus.Warningf("failed to get issue %s: %v", f.URL, err)
+				return []string{""}
+			}
+			assignees := getIssueAssignees(issue)
+			if len(assignees) == 0 {
+				return []string{""}
+			}
+			return assignees
+		}
+	default:
+		return nil, fmt.Errorf("unknown group %q, should be one of issue, assignee and repo", by)
+	}
+	return aggregateFlows(flows, since, keys), nil
+}
+
+// parseSince parses the date in the board timezone, empty means the zero time.
+func parseSince(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, loc)
+}
+
+// serveAPIMetrics serves the flow metrics grouped by the by query parameter,
+// of the issues done since the since query parameter.
+func serveAPIMetrics(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseSince(query.Get("since"), config().boardLocation())
+	if err != nil {
+		writeAPIError(rw, http.StatusBadRequest, "bad since: "+err.Error())
+		return
+	}
+	metrics, err := getFlowMetrics(query.Get("by"), since, time.Now())
+	if err != nil {
+		writeAPIError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	if metrics == nil {
+		metrics = []*flowMetrics{}
+	}
+
+	page, perPage, start, end := paginate(r, len(metrics))
+	writeJSON(rw, http.StatusOK, &apiList{len(metrics), page, perPage, metrics[start:end]})
+}
+
+func formatHours(hours float64) string {
+	if hours == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fd", hours/24)
+}
+
+// runMetrics implements the metrics subcommand, which prints the cycle time,
+// lead time and time in testing of the issues.
+func runMetrics(args []string) error {
+	flags := flag.NewFlagSet("metrics", flag.ExitOnError)
+	registerConfigFlag(flags)
+	by := flags.String("by", metricsByIssue, "group by issue, assignee or repo")
+	sinceFlag := flags.String("since", "", "only count the issues done since the date, e.g. 2018-12-01")
+	jsonOutput := flags.Bool("json", false, "print in json")
+	flags.Parse(args)
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	problems := c.validateBoard()
+	if *by == metricsByAssignee {
+		problems = append(problems, c.validateGithub()...)
+	}
+	err = joinProblems(problems)
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	setConfig(c)
+
+	since, err := parseSince(*sinceFlag, c.boardLocation())
+	if err != nil {
+		return err
+	}
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	if *by == metricsByAssignee {
+		err = initGithubClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	metrics, err := getFlowMetrics(*by, since, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(metrics)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tDONE\tIN PROGRESS\tCYCLE TIME\tLEAD TIME\tIN TESTING")
+	for _, m := range metrics {
+		key := m.Key
+		if key == "" {
+			key = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", key, m.Done, m.InProgress,
+			formatHours(m.CycleTime), formatHours(m.LeadTime), formatHours(m.InTesting))
+	}
+	return w.Flush()
+}
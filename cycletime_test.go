@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueFlows(t *testing.T) {
+	board := boardConfig{DevelopingColumn: "开发", TestingColumn: "测试"}
+	start := time.Date(2018, 12, 3, 9, 0, 0, 0, time.UTC)
+	at := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+	url1 := "https://api.github.com/repos/o/a/issues/1"
+	url2 := "https://api.github.com/repos/o/b/issues/2"
+
+	transitions := []*cardTransition{
+		{CardID: 1, IssueURL: url1, To: "待办", MovedAt: at(0)},
+		{CardID: 2, IssueURL: url2, To: "开发", MovedAt: at(0)},
+		{CardID: 1, IssueURL: url1, From: "待办", To: "开发", MovedAt: at(24)},
+		{CardID: 1, IssueURL: url1, From: "开发", To: "测试", MovedAt: at(48)},
+		// sent back to developing by the qa
+		{CardID: 1, IssueURL: url1, From: "测试", To: "开发", MovedAt: at(52)},
+		{CardID: 1, IssueURL: url1, From: "开发", To: "测试", MovedAt: at(60)},
+		{CardID: 1, IssueURL: url1, From: "测试", To: "完成", MovedAt: at(72)},
+		{CardID: 2, IssueURL: url2, From: "开发", To: "测试", MovedAt: at(10)},
+		{CardID: 3, To: "待办", MovedAt: at(0)},
+	}
+
+	flows := buildIssueFlows(transitions, board, at(100))
+	assert.Len(t, flows, 2)
+
+	f := flows[0]
+	assert.Equal(t, "o/a#1", f.Ref)
+	assert.True(t, f.isDone())
+	assert.Equal(t, 48*time.Hour, f.cycleTime())
+	assert.Equal(t, 72*time.Hour, f.leadTime())
+	assert.Equal(t, 16*time.Hour, f.Testing)
+	assert.Equal(t, 32*time.Hour, f.Developing)
+
+	f = flows[1]
+	assert.False(t, f.isDone())
+	assert.Equal(t, 90*time.Hour, f.Testing)
+
+	metrics := aggregateFlows(flows, time.Time{}, func(f *issueFlow) []string { return []string{"o"} })
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, 1, metrics[0].Done)
+	assert.Equal(t, 1, metrics[0].InProgress)
+	assert.Equal(t, 48.0, metrics[0].CycleTime)
+	assert.Equal(t, 16.0, metrics[0].InTesting)
+
+	metrics = aggregateFlows(flows, at(73), func(f *issueFlow) []string { return []string{f.Repo} })
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "o/b", metrics[0].Key)
+}
+
+func TestRecordCardEvent(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	cardsLock.Lock()
+	metaCards = nil
+	metaColumns = []*github.ProjectColumn{
+		{ID: github.Int64(10), Name: github.String("待办")},
+		{ID: github.Int64(11), Name: github.String("开发")},
+	}
+	cardsLock.Unlock()
+
+	const issueURL = "https://api.github.com/repos/o/a/issues/1"
+	at := time.Date(2018, 12, 3, 9, 0, 0, 0, time.UTC)
+	card := &github.ProjectCard{ID: github.Int64(1), ColumnID: github.Int64(10),
+		UpdatedAt: &github.Timestamp{Time: at}}
+	assert.Nil(t, recordCardEvent("created", card))
+	card.ColumnID = github.Int64(11)
+	card.UpdatedAt = &github.Timestamp{Time: at.Add(time.Hour)}
+	assert.Nil(t, recordCardEvent("moved", card))
+
+	// the note is converted to an issue, so its flow starts when the note
+	// is created.
+	card.ContentURL = github.String(issueURL)
+	assert.Nil(t, recordCardEvent("converted", card))
+	transitions, err := listCardTransitions()
+	assert.Nil(t, err)
+	flows := buildIssueFlows(transitions, boardConfig{DevelopingColumn: "开发", TestingColumn: "测试"}, at.Add(2*time.Hour))
+	if assert.Len(t, flows, 1) {
+		assert.Equal(t, issueURL, flows[0].URL)
+		assert.Equal(t, at, flows[0].Added.UTC())
+		assert.Equal(t, at.Add(time.Hour), flows[0].Started.UTC())
+	}
+}
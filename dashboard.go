@@ -0,0 +1,179 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(templateFS, "templates/dashboard.html"))
+
+type dashboardCard struct {
+	*trackedIssue
+	Overdue      bool
+	DaysInColumn int
+}
+
+func (c *dashboardCard) HasDeadline() bool {
+	return c.hasDeadline()
+}
+
+func (c *dashboardCard) DeadlineDate() string {
+	return formatDate(c.Deadline)
+}
+
+type dashboardColumn struct {
+	Name  string
+	Cards []*dashboardCard
+}
+
+type dashboardPage struct {
+	Project string
+	Teams   []string
+	Team    string
+	// Token is the token given in the query, which is kept in the links
+	// and the filter.
+	Token   string
+	Now     string
+	Total   int
+	Overdue int
+	Columns []*dashboardColumn
+}
+
+// getTeamMembers returns the logins of the members of the team.
+func getTeamMembers(name string) map[string]bool {
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+
+	ret := make(map[string]bool)
+	for _, t := range metaTeams {
+		if t.GetName() == name {
+			for _, m := range t.Members {
+				ret[m.GetLogin()] = true
+			}
+		}
+	}
+	return ret
+}
+
+func getTeamNames() []string {
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+
+	var ret []string
+	for _, t := range metaTeams {
+		ret = append(ret, t.GetName())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// getTargetColumnNames returns the names of the target columns in the
+// order of the board.
+func getTargetColumnNames() []string {
+	cardsLock.Lock()
+	defer cardsLock.Unlock()
+
+	var ret []string
+	for _, col := range metaColumns {
+		if isTargetColumn(col) {
+			ret = append(ret, col.GetName())
+		}
+	}
+	return ret
+}
+
+func buildDashboardPage(issues []*trackedIssue, team string, now time.Time) *dashboardPage {
+	c := config()
+	loc := c.boardLocation()
+	page := &dashboardPage{
+		Project: c.Board.Project,
+		Teams:   getTeamNames(),
+		Team:    team,
+		Now:     now.In(loc).Format("2006-01-02 15:04"),
+	}
+
+	var members map[string]bool
+	if team != "" {
+		members = getTeamMembers(team)
+	}
+
+	columns := make(map[string]*dashboardColumn)
+	for _, name := range getTargetColumnNames() {
+		column := &dashboardColumn{Name: name}
+		columns[name] = column
+		page.Columns = append(page.Columns, column)
+	}
+
+	for _, issue := range issues {
+		if members != nil {
+			inTeam := false
+			for _, assignee := range issue.Assignees {
+				if members[assignee] {
+					inTeam = true
+					break
+				}
+			}
+			if !inTeam {
+				continue
+			}
+		}
+		column, ok := columns[issue.Column]
+		if !ok {
+			continue
+		}
+
+		card := &dashboardCard{trackedIssue: issue}
+		card.Overdue = issue.isOverdueAt(now)
+		if !issue.InColumnSince.IsZero() {
+			card.DaysInColumn = int(now.Sub(issue.InColumnSince).Hours() / 24)
+		}
+		column.Cards = append(column.Cards, card)
+
+		page.Total++
+		if card.Overdue {
+			page.Overdue++
+		}
+	}
+
+	// the overdue cards first, then by the deadline.
+	for _, column := range page.Columns {
+		cards := column.Cards
+		sort.SliceStable(cards, func(i, j int) bool {
+			if cards[i].Overdue != cards[j].Overdue {
+				return cards[i].Overdue
+			}
+			if cards[i].hasDeadline() != cards[j].hasDeadline() {
+				return cards[i].hasDeadline()
+			}
+			return cards[i].Deadline.Before(cards[j].Deadline)
+		})
+	}
+	return page
+}
+
+// serveDashboard renders the board with the deadlines, filtered by the team
+// query parameter. It's wrapped by feedHandler.
+func serveDashboard(rw http.ResponseWriter, r *http.Request) {
+	issues, err := getTrackedIssues()
+	if err != nil {
+		logrus.Warning("failed to get tracked issues: ", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := buildDashboardPage(issues, r.URL.Query().Get("team"), time.Now())
+	page.Token = r.URL.Query().Get("token")
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = dashboardTemplate.Execute(rw, page)
+	if err != nil {
+		logrus.Warning("failed to render dashboard: ", err)
+	}
+}
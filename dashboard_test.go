@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDashboard(t *testing.T) {
+	oldTeams := metaTeams
+	defer func() { metaTeams = oldTeams }()
+	metaTeams = []*team{
+		{&github.Team{Name: github.String("QA Team")}, []*github.User{{Login: github.String("carol")}}},
+		{&github.Team{Name: github.String("Developer Team")}, []*github.User{{Login: github.String("alice")}}},
+	}
+	cardsLock.Lock()
+	metaCards = nil
+	metaColumns = []*github.ProjectColumn{
+		{ID: github.Int64(10), Name: github.String("待办")},
+		{ID: github.Int64(11), Name: github.String(config().Board.DevelopingColumn)},
+		{ID: github.Int64(12), Name: github.String(config().Board.TestingColumn)},
+	}
+	cardsLock.Unlock()
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	now := time.Date(2018, 12, 4, 9, 0, 0, 0, loc)
+	day := func(d int) time.Time {
+		return time.Date(2018, 12, d, 0, 0, 0, 0, time.UTC)
+	}
+	developingColumn, testingColumn := config().Board.DevelopingColumn, config().Board.TestingColumn
+	issues := []*trackedIssue{
+		{Ref: "o/r#1", State: "open", Column: developingColumn, Assignees: []string{"alice"}, Deadline: day(6)},
+		{Ref: "o/r#2", State: "open", Column: developingColumn, Assignees: []string{"bob"}},
+		{Ref: "o/r#3", State: "open", Column: developingColumn, Assignees: []string{"alice"}, Deadline: day(3),
+			InColumnSince: now.AddDate(0, 0, -3)},
+		{Ref: "o/r#4", State: "open", Column: testingColumn, Assignees: []string{"carol"}, Deadline: day(5)},
+		{Ref: "o/r#5", State: "open", Column: "待办"},
+	}
+
+	page := buildDashboardPage(issues, "", now)
+	assert.Equal(t, []string{"Developer Team", "QA Team"}, page.Teams)
+	assert.Equal(t, "2018-12-04 09:00", page.Now)
+	assert.Equal(t, 4, page.Total)
+	assert.Equal(t, 1, page.Overdue)
+	if assert.Len(t, page.Columns, 2) {
+		var refs []string
+		for _, card := range page.Columns[0].Cards {
+			refs = append(refs, card.Ref)
+		}
+		// the overdue card first, then by the deadline.
+		assert.Equal(t, []string{"o/r#3", "o/r#1", "o/r#2"}, refs)
+		assert.Equal(t, 3, page.Columns[0].Cards[0].DaysInColumn)
+		assert.Equal(t, "2018-12-03", page.Columns[0].Cards[0].DeadlineDate())
+	}
+
+	page = buildDashboardPage(issues, "Developer Team", now)
+	assert.Equal(t, 2, page.Total)
+	assert.Len(t, page.Columns[0].Cards, 2)
+	assert.Len(t, page.Columns[1].Cards, 0)
+
+	// the token in the query is kept in the filter and the links.
+	page.Token = "0123456789abcdef"
+	var buf bytes.Buffer
+	assert.Nil(t, dashboardTemplate.Execute(&buf, page))
+	html := buf.String()
+	assert.Contains(t, html, `<option value="Developer Team" selected>`)
+	assert.Contains(t, html, `<input type="hidden" name="token" value="0123456789abcdef">`)
+	assert.Contains(t, html, `href="charts/cfd.svg?token=0123456789abcdef"`)
+	assert.Contains(t, html, "没有卡片")
+
+	c := defaultConfig()
+	c.API.Tokens = []string{"0123456789abcdef"}
+	old := config()
+	defer setConfig(old)
+	setConfig(c)
+	rw := httptest.NewRecorder()
+	feedHandler(serveDashboard)(rw, httptest.NewRequest("GET", "/dashboard?team=QA+Team", nil))
+	assert.Equal(t, 401, rw.Code)
+}
@@ -6,18 +6,37 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/go-github/github"
+	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type IssueDeadline struct {
-	id        int64
+	id int64
+	// date is the day of the deadline, which is resolved in the timezone of
+	// the issue. Only its year, month and day matter, it's stored as a plain
+	// date and loaded as the midnight in UTC.
 	date      time.Time
 	directive string
 	url       string
+	// timezone is the timezone of the issue the day ends in, empty for the
+	// board timezone, see Config.issueTimezone.
+	timezone string
+}
+
+// location returns the location the day of the deadline ends in.
+func (d *IssueDeadline) location() *time.Location {
+	return config().timezoneLocation(d.timezone)
+}
+
+// isPassed checks whether the day of the deadline is over in the timezone
+// of the issue.
+func (d *IssueDeadline) isPassed() bool {
+	return isDeadlinePassed(d.date, d.location())
 }
 
 var regDirectiveDay = regexp.MustCompile(`<(\d+)>`)
@@ -28,16 +47,6 @@ var regDirectiveNextWeekEN = regexp.MustCompile(`<xz(\d)>`)
 var regDirectiveThisWeekCN = regexp.MustCompile(`<周([一二三四五六日])>`)
 var regDirectiveNextWeekCN = regexp.MustCompile(`<下周([一二三四五六日])>`)
 
-var defaultLoc *time.Location
-
-func init() {
-	var err error
-	defaultLoc, err = time.LoadLocation("Asia/Shanghai")
-	if err != nil {
-		logrus.Fatal("failed to load location Asia/Shanghai: ", err)
-	}
-}
-
 // 获取 t 所在的这周内，星期几的日期。
 func getDateInWeek(t time.Time, weekday int) time.Time {
 	tWeekday := int(t.Weekday())
@@ -67,8 +76,16 @@ func formatDate(t time.Time) string {
 	return t.Format(layoutYMD)
 }
 
+// plainDate returns the day of t as the midnight in UTC, so the dates in
+// different timezones can be compared.
+func plainDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// getDeadlineFromTitle parses the directive in the title, the date is resolved
+// in the location of now.
 func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive string, err error) {
-	now = now.In(defaultLoc)
+	loc := now.Location()
 	var day int
 	var month int
 	var year int
@@ -80,7 +97,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 		if err != nil {
 			return
 		}
-		date = time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, loc)
 		directive = match[0]
 		return
 	}
@@ -100,7 +117,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 		if err != nil {
 			return
 		}
-		date = time.Date(now.Year(), time.Month(month), day, 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), time.Month(month), day, 0, 0, 0, 0, loc)
 		directive = match[0]
 		return
 	}
@@ -125,7 +142,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 		if err != nil {
 			return
 		}
-		date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, defaultLoc)
+		date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
 		directive = match[0]
 		return
 	}
@@ -143,7 +160,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 			return
 		}
 
-		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
 		date = getDateInWeek(date, n)
 		directive = match[0]
 		return
@@ -162,7 +179,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 			return
 		}
 
-		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
 		date = getDateInWeek(date, n).AddDate(0, 0, 7)
 		directive = match[0]
 		return
@@ -175,7 +192,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 			return
 		}
 
-		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
 		date = getDateInWeek(date, n)
 		directive = match[0]
 		return
@@ -188,7 +205,7 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 			return
 		}
 
-		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, defaultLoc)
+		date = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
 		date = getDateInWeek(date, n).AddDate(0, 0, 7)
 		directive = match[0]
 		return
@@ -198,15 +215,21 @@ func getDeadlineFromTitle(now time.Time, str string) (date time.Time, directive
 	return
 }
 
-func isDeadlinePassed(t time.Time) bool {
-	now := time.Now().In(defaultLoc)
-	return now.After(t.AddDate(0, 0, 1))
+func isDeadlinePassed(date time.Time, loc *time.Location) bool {
+	return isDeadlinePassedAt(time.Now().In(loc), date)
+}
+
+// isDeadlinePassedAt checks whether the day of the deadline is over in the
+// location of now.
+func isDeadlinePassedAt(now, date time.Time) bool {
+	end := time.Date(date.Year(), date.Month(), date.Day()+1, 0, 0, 0, 0, now.Location())
+	return now.After(end)
 }
 
 func getIssueDeadline(id int64) (*IssueDeadline, error) {
 	var issueDeadline IssueDeadline
-	err := db.QueryRow(`SELECT date,url,directive FROM issue_deadline WHERE id = ?`,
-		id).Scan(&issueDeadline.date, &issueDeadline.url, &issueDeadline.directive)
+	err := db.QueryRow(`SELECT date,url,directive,timezone FROM issue_deadline WHERE id = ?`,
+		id).Scan(&issueDeadline.date, &issueDeadline.url, &issueDeadline.directive, &issueDeadline.timezone)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, nil
@@ -214,14 +237,15 @@ func getIssueDeadline(id int64) (*IssueDeadline, error) {
 		return nil, err
 	default:
 		issueDeadline.id = id
+		issueDeadline.date = plainDate(issueDeadline.date)
 		return &issueDeadline, nil
 	}
 }
 
 func getIssueDeadlineByURL(issueURL string) (*IssueDeadline, error) {
 	var issueDeadline IssueDeadline
-	err := db.QueryRow(`SELECT id,date,directive FROM issue_deadline WHERE url = ?`,
-		issueURL).Scan(&issueDeadline.id, &issueDeadline.date, &issueDeadline.directive)
+	err := db.QueryRow(`SELECT id,date,directive,timezone FROM issue_deadline WHERE url = ?`,
+		issueURL).Scan(&issueDeadline.id, &issueDeadline.date, &issueDeadline.directive, &issueDeadline.timezone)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, nil
@@ -229,19 +253,51 @@ func getIssueDeadlineByURL(issueURL string) (*IssueDeadline, error) {
 		return nil, err
 	default:
 		issueDeadline.url = issueURL
+		issueDeadline.date = plainDate(issueDeadline.date)
 		return &issueDeadline, nil
 	}
 }
 
+func listIssueDeadlines() ([]*IssueDeadline, error) {
+	rows, err := db.Query(`SELECT id,date,url,directive,timezone FROM issue_deadline ORDER BY date`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []*IssueDeadline
+	for rows.Next() {
+		var issueDeadline IssueDeadline
+		err = rows.Scan(&issueDeadline.id, &issueDeadline.date, &issueDeadline.url, &issueDeadline.directive,
+			&issueDeadline.timezone)
+		if err != nil {
+			return nil, err
+		}
+		issueDeadline.date = plainDate(issueDeadline.date)
+		ret = append(ret, &issueDeadline)
+	}
+	return ret, rows.Err()
+}
+
 func addIssueDeadline(issueDeadline *IssueDeadline) error {
-	_, err := db.Exec(`INSERT INTO issue_deadline (id,date,url,directive) VALUES (?,?,?,?)`,
-		issueDeadline.id, issueDeadline.date, issueDeadline.url, issueDeadline.directive)
+	_, err := db.Exec(`INSERT INTO issue_deadline (id,date,url,directive,timezone) VALUES (?,?,?,?,?)`,
+		issueDeadline.id, formatDate(issueDeadline.date), issueDeadline.url, issueDeadline.directive,
+		issueDeadline.timezone)
 	return err
 }
 
 func updateIssueDeadline(issueDeadline *IssueDeadline) error {
-	_, err := db.Exec(`UPDATE issue_deadline SET date = ?, url = ?, directive = ?  WHERE id = ?`,
-		issueDeadline.date, issueDeadline.url, issueDeadline.directive, issueDeadline.id)
+	_, err := db.Exec(`UPDATE issue_deadline SET date = ?, url = ?, directive = ?, timezone = ? WHERE id = ?`,
+		formatDate(issueDeadline.date), issueDeadline.url, issueDeadline.directive, issueDeadline.timezone,
+		issueDeadline.id)
+	return err
+}
+
+// updateIssueDeadlineTimezone keeps the timezone of the deadline of the
+// issue up to date when its assignees change.
+func updateIssueDeadlineTimezone(issue *github.Issue) error {
+	_, err := db.Exec(`UPDATE issue_deadline SET timezone = ? WHERE id = ?`,
+		config().issueTimezone(issue), issue.GetID())
 	return err
 }
 
@@ -250,149 +306,229 @@ func deleteIssueDeadline(id int64) error {
 	return err
 }
 
+func deleteIssueDeadlineByURL(issueURL string) error {
+	_, err := db.Exec("DELETE FROM issue_deadline WHERE url = ?", issueURL)
+	return err
+}
+
 const delayedLabelName = "delayed"
 
-func addDelayedLabelToIssue(issue *github.Issue) error {
+func addDelayedLabelToIssue(log *logrus.Entry, issue *github.Issue) error {
 	for _, label := range issue.Labels {
 		if label.GetName() == delayedLabelName {
 			return nil
 		}
 	}
 
-	owner := issue.GetRepository().GetOwner().GetLogin()
-	repo := issue.GetRepository().GetName()
-	num := issue.GetNumber()
-	return addDelayedLabelToIssueAux(owner, repo, num)
+	owner, repo, err := getIssueRepo(issue)
+	if err != nil {
+		return err
+	}
+	return addDelayedLabelToIssueAux(log, owner, repo, issue.GetNumber())
 }
 
-func addDelayedLabelToIssueAux(owner, repo string, num int) error {
+func addDelayedLabelToIssueAux(log *logrus.Entry, owner, repo string, num int) error {
+	if config().DryRun {
+		return recordAction(log, actionAddLabel, issueRef(owner, repo, num), delayedLabelName)
+	}
+
 	ctx := context.Background()
 	_, _, err := client.Issues.AddLabelsToIssue(ctx, owner, repo, num, []string{delayedLabelName})
 	return err
 }
 
-func removeDelayedLabelForIssue(issue *github.Issue) error {
-	var found bool
+func hasDelayedLabel(issue *github.Issue) bool {
 	for _, label := range issue.Labels {
 		if label.GetName() == delayedLabelName {
-			found = true
-			break
+			return true
 		}
 	}
-	if !found {
+	return false
+}
+
+func removeDelayedLabelForIssue(log *logrus.Entry, issue *github.Issue) error {
+	if !hasDelayedLabel(issue) {
 		return nil
 	}
 
 	ctx := context.Background()
-	owner := issue.GetRepository().GetOwner().GetLogin()
-	repo := issue.GetRepository().GetName()
+	owner, repo, err := getIssueRepo(issue)
+	if err != nil {
+		return err
+	}
 	num := issue.GetNumber()
-	_, err := client.Issues.RemoveLabelForIssue(ctx, owner, repo, num, delayedLabelName)
+	if config().DryRun {
+		return recordAction(log, actionRemoveLabel, issueRef(owner, repo, num), delayedLabelName)
+	}
+
+	_, err = client.Issues.RemoveLabelForIssue(ctx, owner, repo, num, delayedLabelName)
+	if isNotFound(err) {
+		// the label has been removed already, e.g. the event is a redelivery.
+		return nil
+	}
 	return err
 }
 
-func createIssueComment(issue *github.Issue, commentBody string) error {
-	ctx := context.Background()
+func isNotFound(err error) bool {
+	errResp, ok := err.(*github.ErrorResponse)
+	return ok && errResp.Response != nil && errResp.Response.StatusCode == http.StatusNotFound
+}
 
-	var owner string
-	var repo string
+// getIssueRepo returns the repo of the issue, the issues fetched from the API
+// only have the repository url.
+func getIssueRepo(issue *github.Issue) (owner, repo string, err error) {
 	if issue.Repository == nil {
-		var err error
-		owner, repo, err = parseRepoURL(issue.GetRepositoryURL())
-		if err != nil {
-			return err
-		}
-	} else {
-		owner = issue.GetRepository().GetOwner().GetLogin()
-		repo = issue.GetRepository().GetName()
+		return parseRepoURL(issue.GetRepositoryURL())
 	}
+	return issue.GetRepository().GetOwner().GetLogin(), issue.GetRepository().GetName(), nil
+}
 
-	num := issue.GetNumber()
+func createIssueComment(log *logrus.Entry, issue *github.Issue, commentBody string) error {
+	owner, repo, err := getIssueRepo(issue)
+	if err != nil {
+		return err
+	}
+	return createIssueCommentAux(log, owner, repo, issue.GetNumber(), commentBody)
+}
+
+func createIssueCommentAux(log *logrus.Entry, owner, repo string, num int, commentBody string) error {
+	if config().DryRun {
+		return recordAction(log, actionCreateComment, issueRef(owner, repo, num), commentBody)
+	}
+
+	ctx := context.Background()
 	comment := new(github.IssueComment)
 	comment.Body = &commentBody
 	_, _, err := client.Issues.CreateComment(ctx, owner, repo, num, comment)
 	return err
 }
 
-func processIssueDeadline(issue *github.Issue) {
+// editIssueTitle changes the title of the issue.
+func editIssueTitle(log *logrus.Entry, issue *github.Issue, title string) error {
+	owner, repo, err := getIssueRepo(issue)
+	if err != nil {
+		return err
+	}
+	if config().DryRun {
+		return recordAction(log, actionEditTitle, issueRef(owner, repo, issue.GetNumber()), title)
+	}
+
+	ctx := context.Background()
+	edited, _, err := client.Issues.Edit(ctx, owner, repo, issue.GetNumber(), &github.IssueRequest{Title: &title})
+	if err != nil {
+		return err
+	}
+	cacheIssue(edited)
+	return nil
+}
+
+// setTitleDirective returns the title with its directive replaced by the
+// directive, or removed if the directive is empty. The directive is put at
+// the head of a title without one.
+func setTitleDirective(title, directive string) string {
+	_, old, err := getDeadlineFromTitle(time.Now(), title)
+	switch {
+	case err == nil:
+		if directive == "" && strings.Contains(title, old+" ") {
+			old += " "
+		}
+		title = strings.Replace(title, old, directive, 1)
+	case directive != "":
+		title = directive + " " + title
+	}
+	return strings.TrimSpace(title)
+}
+
+// processIssueDeadline syncs the deadline set in the issue title to the db and
+// the delayed label. It's safe to call it repeatedly with the same issue, the
+// comment is only created when the stored directive changes.
+func processIssueDeadline(log *logrus.Entry, issue *github.Issue) error {
+	log = log.WithFields(issueFields(issue))
 	if !isIssueInTargetColumns(issue) {
-		logrus.Infof("issue %d not in target columns", issue.GetNumber())
-		return
+		log.Info("issue not in target columns")
+		return nil
 	}
 
 	title := issue.GetTitle()
-	logrus.Infof("processIssueDeadline title: %q", title)
+	log.WithField("title", title).Info("process issue deadline")
 	id := issue.GetID()
-	now := time.Now()
+	timezone := config().issueTimezone(issue)
+	now := time.Now().In(config().timezoneLocation(timezone))
 	date, directive, err := getDeadlineFromTitle(now, title)
-	if err == nil {
-
-		oldIssueDeadline, err := getIssueDeadline(id)
+	if err != nil {
+		log.Info("cancel set deadline")
+		err = deleteIssueDeadline(id)
 		if err != nil {
-			logrus.Warning("failed to get issue deadline: ", err)
-			return
+			return fmt.Errorf("failed to delete issue deadline: %v", err)
 		}
 
-		var oldDirective string
-		if oldIssueDeadline != nil {
-			oldDirective = oldIssueDeadline.directive
+		err = removeDelayedLabelForIssue(log, issue)
+		if err != nil {
+			return fmt.Errorf("failed to remove delayed label for issue: %v", err)
 		}
+		return nil
+	}
 
-		if oldDirective != directive {
-			// set new deadline
-			logrus.Infof("set new deadline to %s %s", formatDate(date), directive)
-			issueDeadline := IssueDeadline{
-				id:        id,
-				date:      date,
-				directive: directive,
-				url:       issue.GetURL(),
-			}
-			if oldIssueDeadline == nil {
-				err = addIssueDeadline(&issueDeadline)
-				if err != nil {
-					logrus.Warning("failed to add issue deadline: ", err)
-					return
-				}
-			} else {
-				err = updateIssueDeadline(&issueDeadline)
-				if err != nil {
-					logrus.Warning("failed to update issue deadline: ", err)
-					return
-				}
-			}
+	issueDeadline, err := getIssueDeadline(id)
+	if err != nil {
+		return fmt.Errorf("failed to get issue deadline: %v", err)
+	}
 
-			commentBody := fmt.Sprintf("设置截止日期到 %s", formatDate(date))
-			err = createIssueComment(issue, commentBody)
-			if err != nil {
-				logrus.Warning("failed to create issue comment: ", err)
-			}
+	switch {
+	case issueDeadline == nil || issueDeadline.directive != directive:
+		// set new deadline
+		log.Infof("set new deadline to %s %s", formatDate(date), directive)
+		newDeadline := &IssueDeadline{
+			id:        id,
+			date:      date,
+			directive: directive,
+			url:       issue.GetURL(),
+			timezone:  timezone,
 		}
-
-		if isDeadlinePassed(date) {
-			logrus.Info("deadline has passed")
-			err = addDelayedLabelToIssue(issue)
+		if issueDeadline == nil {
+			err = addIssueDeadline(newDeadline)
 			if err != nil {
-				logrus.Warning("failed to add delayed label to issue: ", err)
+				return fmt.Errorf("failed to add issue deadline: %v", err)
 			}
 		} else {
-			logrus.Info("deadline has not passed")
-			err = removeDelayedLabelForIssue(issue)
+			err = updateIssueDeadline(newDeadline)
 			if err != nil {
-				logrus.Warning("failed to remove delayed label for issue: ", err)
+				return fmt.Errorf("failed to update issue deadline: %v", err)
 			}
 		}
+		issueDeadline = newDeadline
 
-	} else {
-		logrus.Info("cancel set deadline")
-		err = deleteIssueDeadline(id)
+		commentBody := fmt.Sprintf("设置截止日期到 %s", formatDate(date))
+		err = createIssueComment(log, issue, commentBody)
 		if err != nil {
-			logrus.Warning("failed to delete issue deadline: ", err)
-			return
+			// the label is still synced below.
+			log.Warning("failed to create issue comment: ", err)
+		}
+
+	case issueDeadline.timezone != timezone:
+		// the date of the same directive is kept, e.g. a weekday isn't moved
+		// to the next week, while the day ends in the timezone of the new
+		// assignee.
+		log.Infof("the deadline now ends in timezone %q", timezone)
+		issueDeadline.timezone = timezone
+		err = updateIssueDeadline(issueDeadline)
+		if err != nil {
+			return fmt.Errorf("failed to update issue deadline: %v", err)
 		}
+	}
 
-		err = removeDelayedLabelForIssue(issue)
+	if issueDeadline.isPassed() {
+		log.Info("deadline has passed")
+		err = addDelayedLabelToIssue(log, issue)
+		if err != nil {
+			return fmt.Errorf("failed to add delayed label to issue: %v", err)
+		}
+	} else {
+		log.Info("deadline has not passed")
+		err = removeDelayedLabelForIssue(log, issue)
 		if err != nil {
-			logrus.Warning("failed to remove delayed label for issue: ", err)
+			return fmt.Errorf("failed to remove delayed label for issue: %v", err)
 		}
 	}
+	return nil
 }
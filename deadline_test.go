@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-github/github"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,3 +52,92 @@ func TestGetDeadlineFromTitle(t *testing.T) {
 	assert.Equal(t, "<下周一>", directive)
 	assert.Equal(t, "2018-12-10", formatDate(t1))
 }
+
+func TestGetDeadlineFromTitleInLocation(t *testing.T) {
+	// Sunday in Los Angeles, but already Monday in Shanghai.
+	t0, err := time.Parse(time.RFC3339, "2018-12-09T20:00:00-08:00")
+	assert.Nil(t, err)
+
+	la, err := time.LoadLocation("America/Los_Angeles")
+	assert.Nil(t, err)
+	t1, _, err := getDeadlineFromTitle(t0.In(la), "<z1> title content")
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-12-03", formatDate(t1))
+	assert.Equal(t, la, t1.Location())
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	t1, _, err = getDeadlineFromTitle(t0.In(shanghai), "<z1> title content")
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-12-10", formatDate(t1))
+}
+
+func TestIsDeadlinePassed(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	date := time.Date(2018, 12, 3, 0, 0, 0, 0, time.UTC)
+
+	assert.False(t, isDeadlinePassedAt(time.Date(2018, 12, 3, 23, 59, 0, 0, shanghai), date))
+	assert.True(t, isDeadlinePassedAt(time.Date(2018, 12, 4, 0, 1, 0, 0, shanghai), date))
+	// still the day of the deadline in Los Angeles.
+	la, err := time.LoadLocation("America/Los_Angeles")
+	assert.Nil(t, err)
+	assert.False(t, isDeadlinePassedAt(time.Date(2018, 12, 4, 0, 1, 0, 0, shanghai).In(la), date))
+}
+
+func TestIssueDeadlineDate(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	// set by an assignee east of the board, the day is kept wherever it's
+	// shown.
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	assert.Nil(t, err)
+	const issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1, date: time.Date(2018, 12, 3, 0, 0, 0, 0, tokyo),
+		url: issueURL, directive: "<12-03>", timezone: "Asia/Tokyo"}))
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-12-03", formatDate(issueDeadline.date))
+	// the day ends in the timezone of the issue.
+	assert.Equal(t, tokyo, issueDeadline.location())
+
+	deadline, err := newAPIDeadline(issueDeadline)
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-12-03", deadline.Date)
+	assert.True(t, deadline.Overdue)
+}
+
+func TestIssueTimezone(t *testing.T) {
+	old := config()
+	defer setConfig(old)
+	c := defaultConfig()
+	c.Board.Timezone = "Asia/Shanghai"
+	c.Board.AssigneeTimezones = map[string]string{"bob": "America/Los_Angeles"}
+	setConfig(c)
+
+	alice := &github.User{Login: github.String("alice")}
+	bob := &github.User{Login: github.String("bob")}
+	assert.Equal(t, "", c.issueTimezone(&github.Issue{Assignees: []*github.User{alice}}))
+	assert.Equal(t, "America/Los_Angeles", c.issueTimezone(&github.Issue{Assignees: []*github.User{alice, bob}}))
+	assert.Equal(t, "Asia/Shanghai", c.timezoneLocation("").String())
+	assert.Equal(t, "Asia/Shanghai", c.timezoneLocation("Nowhere/Else").String())
+
+	// the deadline of 12-03 is over in Shanghai but not yet in Los Angeles.
+	now := time.Date(2018, 12, 4, 2, 0, 0, 0, time.UTC)
+	shanghai := &trackedIssue{State: "open", Deadline: time.Date(2018, 12, 3, 0, 0, 0, 0, time.UTC)}
+	assert.True(t, shanghai.isOverdueAt(now))
+	la := &trackedIssue{State: "open", Deadline: shanghai.Deadline, Location: c.timezoneLocation("America/Los_Angeles")}
+	assert.False(t, la.isOverdueAt(now))
+	la.State = "closed"
+	assert.False(t, la.isOverdueAt(now.AddDate(0, 0, 1)))
+}
+
+func TestSetTitleDirective(t *testing.T) {
+	assert.Equal(t, "<12-25> fix the crash", setTitleDirective("fix the crash", "<12-25>"))
+	assert.Equal(t, "<12-25> fix the crash", setTitleDirective("<z3> fix the crash", "<12-25>"))
+	assert.Equal(t, "fix <12-25> the crash", setTitleDirective("fix <下周五> the crash", "<12-25>"))
+	assert.Equal(t, "fix the crash", setTitleDirective("<z3> fix the crash", ""))
+	assert.Equal(t, "fix the crash", setTitleDirective("fix the crash <3>", ""))
+	assert.Equal(t, "fix the crash", setTitleDirective("fix the crash", ""))
+}
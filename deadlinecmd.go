@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const deadlinesUsage = "usage: %s deadlines list|show|set|clear|recheck [-h]"
+
+var regIssueHTMLURL = regexp.MustCompile(`^https://github\.com/([^/]+)/([^/]+)/issues/(\d+)$`)
+
+// issueAPIURL returns the API url of the issue given by its API url, HTML url
+// or owner/repo#num, the deadlines are keyed by the API url.
+func issueAPIURL(arg string) (string, error) {
+	if _, _, _, err := parseIssueURL(arg); err == nil {
+		return arg, nil
+	}
+	if match := regIssueHTMLURL.FindStringSubmatch(arg); match != nil {
+		return fmt.Sprintf("https://api.github.com/repos/%s/%s/issues/%s", match[1], match[2], match[3]), nil
+	}
+	owner, repo, num, err := parseIssueRef(arg)
+	if err != nil {
+		return "", fmt.Errorf("invalid issue %q, expect its url or owner/repo#num", arg)
+	}
+	return fmt.Sprintf("https://api.github.com/repos/%s/%s/issues/%d", owner, repo, num), nil
+}
+
+// deadlineDetail is the deadline with the dates of its reminders.
+type deadlineDetail struct {
+	*apiDeadline
+	Reminded []string `json:"reminded"`
+}
+
+func getDeadlineDetail(issueURL string) (*deadlineDetail, error) {
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	if err != nil || issueDeadline == nil {
+		return nil, err
+	}
+	deadline, err := newAPIDeadline(issueDeadline)
+	if err != nil {
+		return nil, err
+	}
+	reminded, err := listDeadlineReminders(issueDeadline.id)
+	if err != nil {
+		return nil, err
+	}
+	return &deadlineDetail{deadline, reminded}, nil
+}
+
+func writeDeadlines(out io.Writer, deadlines []*apiDeadline, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(deadlines)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ISSUE\tDATE\tDIRECTIVE\tOVERDUE")
+	for _, d := range deadlines {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", d.Ref, d.Date, d.Directive, d.Overdue)
+	}
+	return w.Flush()
+}
+
+func writeDeadlineDetail(out io.Writer, issueURL string, detail *deadlineDetail, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(detail)
+	}
+	if detail == nil {
+		_, err := fmt.Fprintf(out, "%s has no deadline\n", issueURL)
+		return err
+	}
+
+	reminded := strings.Join(detail.Reminded, ", ")
+	if reminded == "" {
+		reminded = "-"
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Issue:\t%s\n", detail.Ref)
+	fmt.Fprintf(w, "URL:\t%s\n", detail.URL)
+	fmt.Fprintf(w, "ID:\t%d\n", detail.ID)
+	fmt.Fprintf(w, "Date:\t%s\n", detail.Date)
+	fmt.Fprintf(w, "Directive:\t%s\n", detail.Directive)
+	fmt.Fprintf(w, "Overdue:\t%v\n", detail.Overdue)
+	fmt.Fprintf(w, "Reminded:\t%s\n", reminded)
+	return w.Flush()
+}
+
+// setupDeadlinesCommand loads the config and opens the database, the github
+// client is only needed by the commands changing the deadlines.
+func setupDeadlinesCommand(withGithub, dryRun bool) (*Config, error) {
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		c.DryRun = true
+	}
+	problems := c.validateBoard()
+	if withGithub {
+		problems = append(problems, c.validateGithub()...)
+	}
+	err = joinProblems(problems)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	setConfig(c)
+	err = setupLogging(c)
+	if err != nil {
+		return nil, err
+	}
+
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if withGithub {
+		err = initGithubClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// runDeadlines implements the deadlines subcommand, which inspects and
+// edits the deadlines in the database.
+func runDeadlines(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(deadlinesUsage, os.Args[0])
+	}
+	switch args[0] {
+	case "list":
+		return runDeadlinesList(args[1:])
+	case "show":
+		return runDeadlinesShow(args[1:])
+	case "set":
+		return runDeadlinesSet(args[1:])
+	case "clear":
+		return runDeadlinesClear(args[1:])
+	case "recheck":
+		return runDeadlinesRecheck(args[1:])
+	}
+	return fmt.Errorf(deadlinesUsage, os.Args[0])
+}
+
+func runDeadlinesList(args []string) error {
+	flags := flag.NewFlagSet("deadlines list", flag.ExitOnError)
+	registerConfigFlag(flags)
+	jsonOutput := flags.Bool("json", false, "print in json")
+	overdue := flags.Bool("overdue", false, "only list the overdue deadlines")
+	flags.Parse(args)
+
+	_, err := setupDeadlinesCommand(false, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	issueDeadlines, err := listIssueDeadlines()
+	if err != nil {
+		return err
+	}
+	deadlines := []*apiDeadline{}
+	for _, issueDeadline := range issueDeadlines {
+		deadline, err := newAPIDeadline(issueDeadline)
+		if err != nil {
+			logrus.Warningf("skip the deadline of %s: %v", issueDeadline.url, err)
+			continue
+		}
+		if *overdue && !deadline.Overdue {
+			continue
+		}
+		deadlines = append(deadlines, deadline)
+	}
+	return writeDeadlines(os.Stdout, deadlines, *jsonOutput)
+}
+
+func runDeadlinesShow(args []string) error {
+	flags := flag.NewFlagSet("deadlines show", flag.ExitOnError)
+	registerConfigFlag(flags)
+	jsonOutput := flags.Bool("json", false, "print in json")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s deadlines show [-json] <url|owner/repo#num>", os.Args[0])
+	}
+	issueURL, err := issueAPIURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	_, err = setupDeadlinesCommand(false, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	detail, err := getDeadlineDetail(issueURL)
+	if err != nil {
+		return err
+	}
+	return writeDeadlineDetail(os.Stdout, issueURL, detail, *jsonOutput)
+}
+
+// runDeadlinesSet sets the deadline of the issue like it's set in the title,
+// the value is a directive such as 12-25 or z3. The directive in the title is
+// replaced as well, so the title edits and the backfill keep the deadline.
+func runDeadlinesSet(args []string) error {
+	flags := flag.NewFlagSet("deadlines set", flag.ExitOnError)
+	registerConfigFlag(flags)
+	jsonOutput := flags.Bool("json", false, "print in json")
+	syncLabels := flags.Bool("sync-labels", false, "add or remove the delayed label of the issue")
+	dryRun := flags.Bool("dry-run", false, "log and record the changes to Github instead of doing them")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: %s deadlines set [-json] [-sync-labels] [-dry-run] <url|owner/repo#num> <directive>", os.Args[0])
+	}
+	issueURL, err := issueAPIURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	c, err := setupDeadlinesCommand(true, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return setDeadline(os.Stdout, c, issueURL, flags.Arg(1), *syncLabels, *jsonOutput)
+}
+
+// setDeadline sets the deadline of the issue to the directive and prints
+// it, the delayed label is synced if syncLabels.
+func setDeadline(out io.Writer, c *Config, issueURL, arg string, syncLabels, jsonOutput bool) error {
+	issue, err := fetchIssue(issueURL)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithField("command", "deadlines set").WithFields(issueFields(issue))
+	timezone := c.issueTimezone(issue)
+	directive := arg
+	if !strings.HasPrefix(directive, "<") {
+		directive = "<" + directive + ">"
+	}
+	date, directive, err := getDeadlineFromTitle(time.Now().In(c.timezoneLocation(timezone)), directive)
+	if err != nil {
+		return fmt.Errorf("invalid directive %q: %v", arg, err)
+	}
+
+	issueDeadline := &IssueDeadline{
+		id:        issue.GetID(),
+		date:      date,
+		url:       issueURL,
+		directive: directive,
+		timezone:  timezone,
+	}
+	old, err := getIssueDeadline(issue.GetID())
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		err = addIssueDeadline(issueDeadline)
+	} else {
+		err = updateIssueDeadline(issueDeadline)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("set deadline to %s %s", formatDate(date), directive)
+
+	title := setTitleDirective(issue.GetTitle(), directive)
+	if title != issue.GetTitle() {
+		err = editIssueTitle(log, issue, title)
+		if err != nil {
+			return fmt.Errorf("failed to set the directive in the title: %v", err)
+		}
+	}
+
+	if syncLabels {
+		if issueDeadline.isPassed() {
+			err = addDelayedLabelToIssue(log, issue)
+		} else {
+			err = removeDelayedLabelForIssue(log, issue)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync the delayed label: %v", err)
+		}
+	}
+
+	detail, err := getDeadlineDetail(issueURL)
+	if err != nil {
+		return err
+	}
+	return writeDeadlineDetail(out, issueURL, detail, jsonOutput)
+}
+
+func runDeadlinesClear(args []string) error {
+	flags := flag.NewFlagSet("deadlines clear", flag.ExitOnError)
+	registerConfigFlag(flags)
+	syncLabels := flags.Bool("sync-labels", false, "remove the delayed label of the issue")
+	dryRun := flags.Bool("dry-run", false, "log and record the changes to Github instead of doing them")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s deadlines clear [-sync-labels] [-dry-run] <url|owner/repo#num>", os.Args[0])
+	}
+	issueURL, err := issueAPIURL(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	_, err = setupDeadlinesCommand(true, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return clearDeadline(issueURL, *syncLabels)
+}
+
+// clearDeadline deletes the deadline of the issue and the directive in its
+// title, and removes its delayed label if syncLabels.
+func clearDeadline(issueURL string, syncLabels bool) error {
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	if err != nil {
+		return err
+	}
+	if issueDeadline == nil {
+		return fmt.Errorf("%s has no deadline", issueURL)
+	}
+	err = deleteIssueDeadline(issueDeadline.id)
+	if err != nil {
+		return err
+	}
+	log := logrus.WithFields(logrus.Fields{"command": "deadlines clear", "issue": issueURL})
+	log.Infof("cleared deadline %s %s", formatDate(issueDeadline.date), issueDeadline.directive)
+
+	issue, err := fetchIssue(issueURL)
+	if err != nil {
+		return err
+	}
+	title := setTitleDirective(issue.GetTitle(), "")
+	if title != issue.GetTitle() {
+		err = editIssueTitle(log, issue, title)
+		if err != nil {
+			return fmt.Errorf("failed to remove the directive from the title: %v", err)
+		}
+	}
+
+	if syncLabels {
+		err = removeDelayedLabelForIssue(log, issue)
+		if err != nil {
+			return fmt.Errorf("failed to sync the delayed label: %v", err)
+		}
+	}
+	return nil
+}
+
+// runDeadlinesRecheck syncs the deadlines of the issues from their titles,
+// like the backfill does for all the issues on the board.
+func runDeadlinesRecheck(args []string) error {
+	flags := flag.NewFlagSet("deadlines recheck", flag.ExitOnError)
+	registerConfigFlag(flags)
+	jsonOutput := flags.Bool("json", false, "print in json")
+	dryRun := flags.Bool("dry-run", false, "log and record the changes to Github instead of doing them")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: %s deadlines recheck [-json] [-dry-run] <url|owner/repo#num>...", os.Args[0])
+	}
+	var issueURLs []string
+	for _, arg := range flags.Args() {
+		issueURL, err := issueAPIURL(arg)
+		if err != nil {
+			return err
+		}
+		issueURLs = append(issueURLs, issueURL)
+	}
+
+	_, err := setupDeadlinesCommand(true, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	// the deadlines are only kept for the issues in the target columns.
+	err = PrepareKanbanMetadata()
+	if err != nil {
+		return err
+	}
+
+	return recheckDeadlines(os.Stdout, issueURLs, *jsonOutput)
+}
+
+// recheckDeadlines syncs the deadlines of the issues on the board and prints
+// them, the board metadata must be loaded.
+func recheckDeadlines(out io.Writer, issueURLs []string, jsonOutput bool) error {
+	var failed []string
+	log := logrus.WithField("command", "deadlines recheck")
+	for _, issueURL := range issueURLs {
+		err := backfillIssueDeadline(log, issueURL)
+		if err != nil {
+			log.Warningf("failed to recheck the deadline of %s: %v", issueURL, err)
+			failed = append(failed, issueURL)
+			continue
+		}
+		detail, err := getDeadlineDetail(issueURL)
+		if err != nil {
+			return err
+		}
+		err = writeDeadlineDetail(out, issueURL, detail, jsonOutput)
+		if err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New("failed to recheck " + strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssueAPIURL(t *testing.T) {
+	const issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/12"
+	for _, arg := range []string{issueURL, "https://github.com/linuxdeepin/dde/issues/12", "linuxdeepin/dde#12"} {
+		u, err := issueAPIURL(arg)
+		assert.Nil(t, err)
+		assert.Equal(t, issueURL, u)
+	}
+	_, err := issueAPIURL("dde#12")
+	assert.NotNil(t, err)
+}
+
+func TestWriteDeadlines(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	deadline, err := newAPIDeadline(&IssueDeadline{
+		id:        1001,
+		date:      time.Date(2018, 12, 3, 0, 0, 0, 0, loc),
+		url:       "https://api.github.com/repos/linuxdeepin/dde/issues/12",
+		directive: "<12-03>",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "linuxdeepin/dde#12", deadline.Ref)
+	assert.True(t, deadline.Overdue)
+
+	var out bytes.Buffer
+	assert.Nil(t, writeDeadlines(&out, []*apiDeadline{deadline}, false))
+	assert.Equal(t, "ISSUE               DATE        DIRECTIVE  OVERDUE\n"+
+		"linuxdeepin/dde#12  2018-12-03  <12-03>    true\n", out.String())
+
+	out.Reset()
+	detail := &deadlineDetail{deadline, []string{"2018-12-03"}}
+	assert.Nil(t, writeDeadlineDetail(&out, deadline.URL, detail, true))
+	assert.Contains(t, out.String(), `"reminded": [`)
+	assert.Contains(t, out.String(), `"ref": "linuxdeepin/dde#12"`)
+
+	out.Reset()
+	assert.Nil(t, writeDeadlineDetail(&out, deadline.URL, nil, false))
+	assert.Equal(t, deadline.URL+" has no deadline\n", out.String())
+}
+
+func TestDeadlinesCommands(t *testing.T) {
+	const (
+		repoURL   = "https://api.github.com/repos/linuxdeepin/dde"
+		urlManual = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+		urlTitle  = "https://api.github.com/repos/linuxdeepin/dde/issues/2"
+		urlGone   = "https://api.github.com/repos/linuxdeepin/dde/issues/9"
+	)
+	var board bytes.Buffer
+	fake := &fakeBoard{
+		out:      &board,
+		Projects: []*fakeProject{{ID: 1, Name: config().Board.Project}},
+		Columns: []*fakeColumn{
+			{ID: 11, ProjectID: 1, Name: config().Board.DevelopingColumn},
+			{ID: 12, ProjectID: 1, Name: config().Board.TestingColumn},
+		},
+		Cards: []*fakeCard{
+			{ID: 101, ColumnID: 11, ContentURL: urlManual},
+			{ID: 102, ColumnID: 12, ContentURL: urlTitle},
+		},
+		Issues: []*github.Issue{
+			{ID: github.Int64(1001), Number: github.Int(1), URL: github.String(urlManual),
+				RepositoryURL: github.String(repoURL), Title: github.String("fix the crash")},
+			{ID: github.Int64(1002), Number: github.Int(2), URL: github.String(urlTitle),
+				RepositoryURL: github.String(repoURL), Title: github.String("<2018-12-01> fix the typo")},
+		},
+	}
+	var stop func()
+	client, stop = fake.newClient()
+	defer stop()
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	c := config()
+
+	// set a passed deadline in the title, and sync the label.
+	var out bytes.Buffer
+	assert.Nil(t, setDeadline(&out, c, urlManual, "2018-12-01", true, false))
+	issueDeadline, err := getIssueDeadlineByURL(urlManual)
+	assert.Nil(t, err)
+	assert.Equal(t, "<2018-12-01>", issueDeadline.directive)
+	assert.Contains(t, out.String(), "linuxdeepin/dde#1")
+	assert.Contains(t, board.String(), "edit title of linuxdeepin/dde#1: <2018-12-01> fix the crash")
+	assert.Contains(t, board.String(), `add label "delayed" to linuxdeepin/dde#1`)
+
+	// move it to the future, which replaces the directive and removes the
+	// label.
+	board.Reset()
+	out.Reset()
+	later := formatDate(time.Now().In(c.boardLocation()).AddDate(0, 0, 10))
+	assert.Nil(t, setDeadline(&out, c, urlManual, "<"+later+">", true, true))
+	assert.Contains(t, out.String(), `"date": "`+later+`"`)
+	assert.Contains(t, board.String(), "edit title of linuxdeepin/dde#1: <"+later+"> fix the crash")
+	assert.Contains(t, board.String(), `remove label "delayed" from linuxdeepin/dde#1`)
+
+	// the label is only synced if asked.
+	board.Reset()
+	assert.Nil(t, setDeadline(&out, c, urlManual, "2018-12-01", false, false))
+	assert.NotContains(t, board.String(), "label")
+	assert.NotNil(t, setDeadline(&out, c, urlManual, "someday", false, false))
+	assert.NotNil(t, setDeadline(&out, c, urlGone, "2018-12-01", false, false))
+
+	// clear it, and remove the label.
+	assert.Nil(t, setDeadline(&out, c, urlManual, "2018-12-01", true, false))
+	board.Reset()
+	assert.Nil(t, clearDeadline(urlManual, true))
+	issueDeadline, err = getIssueDeadlineByURL(urlManual)
+	assert.Nil(t, err)
+	assert.Nil(t, issueDeadline)
+	assert.Contains(t, board.String(), "edit title of linuxdeepin/dde#1: fix the crash")
+	assert.Contains(t, board.String(), `remove label "delayed" from linuxdeepin/dde#1`)
+	assert.NotNil(t, clearDeadline(urlManual, false))
+
+	// the backfill keeps the deadline set, and doesn't bring back the one
+	// cleared.
+	assert.Nil(t, PrepareKanbanMetadata())
+	log := logrus.WithField("job", "deadline-backfill")
+	assert.Nil(t, setDeadline(&out, c, urlManual, "2018-12-02", false, false))
+	board.Reset()
+	assert.Nil(t, backfillDeadlines(log, 2))
+	issueDeadline, err = getIssueDeadlineByURL(urlManual)
+	assert.Nil(t, err)
+	assert.Equal(t, "<2018-12-02>", issueDeadline.directive)
+	assert.NotContains(t, board.String(), "comment on linuxdeepin/dde#1")
+	assert.Nil(t, clearDeadline(urlManual, false))
+	assert.Nil(t, backfillDeadlines(log, 2))
+	issueDeadline, err = getIssueDeadlineByURL(urlManual)
+	assert.Nil(t, err)
+	assert.Nil(t, issueDeadline)
+
+	// recheck takes the deadlines from the titles, the one of #2 was synced
+	// by the backfill above.
+	out.Reset()
+	board.Reset()
+	assert.Nil(t, recheckDeadlines(&out, []string{urlManual, urlTitle}, false))
+	issueDeadline, err = getIssueDeadlineByURL(urlTitle)
+	assert.Nil(t, err)
+	assert.Equal(t, "<2018-12-01>", issueDeadline.directive)
+	assert.Contains(t, out.String(), urlManual+" has no deadline")
+	assert.Contains(t, out.String(), "linuxdeepin/dde#2")
+	assert.Empty(t, board.String())
+
+	err = recheckDeadlines(&out, []string{urlGone, urlTitle}, false)
+	assert.EqualError(t, err, "failed to recheck "+urlGone)
+}
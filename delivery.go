@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// deliveryRetention is how long a delivery ID is remembered. GitHub only
+// allows redelivering recent deliveries, so there's no need to keep them forever.
+const deliveryRetention = 30 * 24 * time.Hour
+
+// recordDelivery records the webhook delivery, returns false if the delivery
+// has already been recorded, which means it's a redelivery.
+func recordDelivery(q querier, deliveryID, event string) (bool, error) {
+	res, err := q.Exec(`INSERT INTO webhook_delivery (id,event,received_at) VALUES (?,?,?)
+		ON CONFLICT DO NOTHING`,
+		deliveryID, event, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// forgetDelivery forgets the delivery, so its redelivery is processed.
+func forgetDelivery(deliveryID string) error {
+	_, err := db.Exec("DELETE FROM webhook_delivery WHERE id = ?", deliveryID)
+	return err
+}
+
+func pruneDeliveries(before time.Time) error {
+	_, err := db.Exec("DELETE FROM webhook_delivery WHERE received_at < ?", before)
+	return err
+}
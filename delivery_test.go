@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveries(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	fresh, err := recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	fresh, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.False(t, fresh)
+
+	assert.Nil(t, forgetDelivery("d1"))
+	fresh, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+
+	assert.Nil(t, pruneDeliveries(time.Now().Add(time.Hour)))
+	fresh, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+}
+
+func TestFailedDeliveryRedelivered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "bad gateway", http.StatusBadGateway)
+	}))
+	defer server.Close()
+	old := client
+	defer func() { client = old }()
+	client = github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	cardsLock.Lock()
+	metaCards = nil
+	metaColumns = []*github.ProjectColumn{
+		{ID: github.Int64(11), Name: github.String(config().Board.DevelopingColumn)},
+	}
+	cardsLock.Unlock()
+
+	process := func(deliveryID, event, payload string) bool {
+		fresh, err := queueDelivery(deliveryID, event, []byte(payload))
+		assert.Nil(t, err)
+		if fresh {
+			upTo, err := lastQueuedWebhookID()
+			assert.Nil(t, err)
+			webhooks, err := listPendingWebhooks(upTo, webhookQueueBatch)
+			assert.Nil(t, err)
+			for _, w := range webhooks {
+				processQueuedWebhook(w)
+			}
+		}
+		return fresh
+	}
+
+	// the issue of the card can't be fetched, so the delivery fails and its
+	// redelivery is processed.
+	const created = `{"action":"created","organization":{"login":"linuxdeepin"},
+		"project_card":{"id":101,"column_id":11,"content_url":"https://api.github.com/repos/linuxdeepin/dde/issues/1"}}`
+	assert.True(t, process("d1", "project_card", created))
+	assert.True(t, process("d1", "project_card", created))
+
+	// the redelivery of a processed delivery is skipped.
+	assert.True(t, process("d2", "ping", `{"zen":"Design for failure."}`))
+	assert.False(t, process("d2", "ping", `{"zen":"Design for failure."}`))
+}
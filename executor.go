@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// keyedExecutor runs tasks submitted with the same key one by one in the
+// order they are submitted, while tasks with different keys run in parallel.
+type keyedExecutor struct {
+	mu     sync.Mutex
+	queues map[string][]func()
+	wg     sync.WaitGroup
+}
+
+func newKeyedExecutor() *keyedExecutor {
+	return &keyedExecutor{
+		queues: make(map[string][]func()),
+	}
+}
+
+// Submit queues the task after the tasks with the same key.
+func (e *keyedExecutor) Submit(key string, task func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.wg.Add(1)
+	queue, running := e.queues[key]
+	e.queues[key] = append(queue, task)
+	if !running {
+		go e.run(key)
+	}
+}
+
+// Run submits the task like Submit, and waits for it to return. A panic of
+// the task is returned as its error.
+func (e *keyedExecutor) Run(key string, task func() error) error {
+	done := make(chan error, 1)
+	e.Submit(key, func() {
+		done <- protect(task)
+	})
+	return <-done
+}
+
+func (e *keyedExecutor) run(key string) {
+	for {
+		e.mu.Lock()
+		queue := e.queues[key]
+		if len(queue) == 0 {
+			delete(e.queues, key)
+			e.mu.Unlock()
+			return
+		}
+		task := queue[0]
+		queue[0] = nil
+		e.queues[key] = queue[1:]
+		e.mu.Unlock()
+
+		// a panic would leave the key busy forever.
+		err := protect(func() error {
+			task()
+			return nil
+		})
+		if err != nil {
+			logrus.WithField("key", key).Error("the task failed: ", err)
+		}
+		e.wg.Done()
+	}
+}
+
+// protect runs the task, and returns its panic as the error.
+func protect(task func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return task()
+}
+
+// Pending returns the number of the tasks waiting to run.
+func (e *keyedExecutor) Pending() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := 0
+	for _, queue := range e.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// Wait blocks until all the submitted tasks are done.
+func (e *keyedExecutor) Wait() {
+	e.wg.Wait()
+}
+
+// Drain waits for the submitted tasks like Wait, but gives up when ctx is
+// done.
+func (e *keyedExecutor) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		e.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// issueExecutor serializes the processing of the same issue.
+var issueExecutor = newKeyedExecutor()
+
+// webhookExecutor handles the queued webhooks of the same issue in the order
+// they were received, while the ones of different issues run in parallel.
+// The handling goes through the issueExecutor as well, so it's a separate
+// executor.
+var webhookExecutor = newKeyedExecutor()
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedExecutorOrder(t *testing.T) {
+	e := newKeyedExecutor()
+
+	var mu sync.Mutex
+	var got []int
+	for i := 0; i < 100; i++ {
+		i := i
+		e.Submit("issue", func() {
+			mu.Lock()
+			got = append(got, i)
+			mu.Unlock()
+		})
+	}
+	e.Wait()
+
+	assert.Len(t, got, 100)
+	for i, v := range got {
+		assert.Equal(t, i, v)
+	}
+}
+
+func TestKeyedExecutorParallel(t *testing.T) {
+	e := newKeyedExecutor()
+
+	block := make(chan struct{})
+	done := make(chan struct{})
+	e.Submit("a", func() { <-block })
+	e.Submit("b", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task of key b is blocked by key a")
+	}
+	close(block)
+	e.Wait()
+}
+
+func TestKeyedExecutorDrain(t *testing.T) {
+	e := newKeyedExecutor()
+
+	block := make(chan struct{})
+	e.Submit("a", func() { <-block })
+	e.Submit("a", func() {})
+	assert.True(t, e.Pending() > 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, e.Drain(ctx))
+
+	close(block)
+	assert.Nil(t, e.Drain(context.Background()))
+	assert.Equal(t, 0, e.Pending())
+}
+
+func TestKeyedExecutorPanic(t *testing.T) {
+	e := newKeyedExecutor()
+
+	err := e.Run("a", func() error { panic("boom") })
+	assert.EqualError(t, err, "panic: boom")
+	e.Submit("a", func() { panic("boom") })
+	// the key isn't left busy by the panics.
+	assert.Nil(t, e.Run("a", func() error { return nil }))
+	e.Wait()
+	assert.Equal(t, 0, e.Pending())
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// botTables are the tables of the bot state, in the order they're cleared
+// by the import.
+var botTables = []string{"issue_deadline", "deadline_reminder", "card_transition", "bot_action",
+	"job_run", "webhook_delivery", "webhook_queue", "flow_snapshot", "burndown_snapshot"}
+
+// botState is the portable form of the bot state. The issues are keyed by
+// their URLs, the rows of the other tables are kept without the ids of the
+// database.
+type botState struct {
+	SchemaVersion     int                     `json:"schema_version"`
+	ExportedAt        time.Time               `json:"exported_at"`
+	Issues            map[string]*issueState  `json:"issues"`
+	CardTransitions   []*cardTransitionState  `json:"card_transitions"`
+	BotActions        []*botActionState       `json:"bot_actions"`
+	JobRuns           []*jobRunState          `json:"job_runs"`
+	WebhookDeliveries []*webhookDeliveryState `json:"webhook_deliveries"`
+	QueuedWebhooks    []*queuedWebhookState   `json:"queued_webhooks"`
+	FlowSnapshots     []*flowSnapshotState    `json:"flow_snapshots"`
+	BurndownSnapshots []*burndownDay          `json:"burndown_snapshots"`
+}
+
+type issueState struct {
+	// IssueID is the ID of the issue on Github.
+	IssueID int64 `json:"issue_id"`
+	// Date is the plain date of the deadline.
+	Date      string `json:"date"`
+	Directive string `json:"directive"`
+	// Timezone is the timezone the day of the deadline ends in, empty for
+	// the board timezone.
+	Timezone string `json:"timezone,omitempty"`
+	// Reminded are the dates the reminders of the deadline were posted.
+	Reminded []string `json:"reminded,omitempty"`
+}
+
+type cardTransitionState struct {
+	CardID   int64     `json:"card_id"`
+	IssueURL string    `json:"issue_url"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	MovedAt  time.Time `json:"moved_at"`
+}
+
+type botActionState struct {
+	CreatedAt time.Time `json:"created_at"`
+	Kind      string    `json:"kind"`
+	Target    string    `json:"target"`
+	Detail    string    `json:"detail"`
+}
+
+type jobRunState struct {
+	Name     string    `json:"name"`
+	LastRun  time.Time `json:"last_run"`
+	Duration int64     `json:"duration_ms"`
+	Error    string    `json:"error"`
+}
+
+type webhookDeliveryState struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// queuedWebhookState is a webhook not done yet, the done ones are only kept
+// for the replicas behind.
+type queuedWebhookState struct {
+	Delivery   string    `json:"delivery"`
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+type flowSnapshotState struct {
+	Date     string `json:"date"`
+	Position int    `json:"position"`
+	Column   string `json:"column"`
+	Count    int    `json:"count"`
+}
+
+// exportState reads the whole bot state in a transaction, so it's
+// consistent while the bot is running.
+func exportState(now time.Time) (*botState, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	s := &botState{ExportedAt: now, Issues: make(map[string]*issueState)}
+	s.SchemaVersion, err = getSchemaVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int64]*issueState)
+	err = queryRows(tx, `SELECT id,date,url,directive,timezone FROM issue_deadline ORDER BY url`, func(scan func(...interface{}) error) error {
+		var url string
+		var date time.Time
+		issue := &issueState{}
+		err := scan(&issue.IssueID, &date, &url, &issue.Directive, &issue.Timezone)
+		if err != nil {
+			return err
+		}
+		issue.Date = formatDate(date)
+		s.Issues[url] = issue
+		byID[issue.IssueID] = issue
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT id,date FROM deadline_reminder ORDER BY id, date`, func(scan func(...interface{}) error) error {
+		var id int64
+		var date string
+		err := scan(&id, &date)
+		if err != nil {
+			return err
+		}
+		// the reminders of the deleted deadlines are useless.
+		if issue := byID[id]; issue != nil {
+			issue.Reminded = append(issue.Reminded, date)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryRows(tx, `SELECT card_id,issue_url,from_column,to_column,moved_at FROM card_transition ORDER BY id`,
+		func(scan func(...interface{}) error) error {
+			t := &cardTransitionState{}
+			s.CardTransitions = append(s.CardTransitions, t)
+			return scan(&t.CardID, &t.IssueURL, &t.From, &t.To, &t.MovedAt)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT created_at,kind,target,detail FROM bot_action ORDER BY id`,
+		func(scan func(...interface{}) error) error {
+			a := &botActionState{}
+			s.BotActions = append(s.BotActions, a)
+			return scan(&a.CreatedAt, &a.Kind, &a.Target, &a.Detail)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT name,last_run,duration_ms,error FROM job_run ORDER BY name`,
+		func(scan func(...interface{}) error) error {
+			r := &jobRunState{}
+			s.JobRuns = append(s.JobRuns, r)
+			return scan(&r.Name, &r.LastRun, &r.Duration, &r.Error)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT id,event,received_at FROM webhook_delivery ORDER BY received_at, id`,
+		func(scan func(...interface{}) error) error {
+			d := &webhookDeliveryState{}
+			s.WebhookDeliveries = append(s.WebhookDeliveries, d)
+			return scan(&d.ID, &d.Event, &d.ReceivedAt)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT delivery,event,payload,received_at FROM webhook_queue
+		WHERE done_at IS NULL ORDER BY id`,
+		func(scan func(...interface{}) error) error {
+			w := &queuedWebhookState{}
+			s.QueuedWebhooks = append(s.QueuedWebhooks, w)
+			return scan(&w.Delivery, &w.Event, &w.Payload, &w.ReceivedAt)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT date,position,column_name,count FROM flow_snapshot ORDER BY date, position`,
+		func(scan func(...interface{}) error) error {
+			f := &flowSnapshotState{}
+			s.FlowSnapshots = append(s.FlowSnapshots, f)
+			return scan(&f.Date, &f.Position, &f.Column, &f.Count)
+		})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(tx, `SELECT date,remaining,with_deadline,overdue FROM burndown_snapshot ORDER BY date`,
+		func(scan func(...interface{}) error) error {
+			b := &burndownDay{}
+			s.BurndownSnapshots = append(s.BurndownSnapshots, b)
+			return scan(&b.Date, &b.Remaining, &b.WithDeadline, &b.Overdue)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// queryRows calls fn with the scan of every row of the query.
+func queryRows(q querier, query string, fn func(scan func(...interface{}) error) error) error {
+	rows, err := q.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = fn(rows.Scan)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// importState writes the bot state in a transaction. The tables must be
+// empty unless replace, which clears them first.
+func importState(s *botState, replace bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range botTables {
+		if replace {
+			_, err = tx.Exec("DELETE FROM " + table)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var count int
+		err = tx.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("table %s isn't empty, import with -replace to overwrite the state", table)
+		}
+	}
+
+	for url, issue := range s.Issues {
+		date, err := time.Parse(layoutYMD, issue.Date)
+		if err != nil {
+			return fmt.Errorf("invalid date %q of the deadline of %s", issue.Date, url)
+		}
+		_, err = tx.Exec(`INSERT INTO issue_deadline (id,date,url,directive,timezone) VALUES (?,?,?,?,?)`,
+			issue.IssueID, formatDate(date), url, issue.Directive, issue.Timezone)
+		if err != nil {
+			return fmt.Errorf("failed to import the deadline of %s: %v", url, err)
+		}
+		for _, date := range issue.Reminded {
+			_, err = tx.Exec(`INSERT INTO deadline_reminder (id,date) VALUES (?,?)`, issue.IssueID, date)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range s.CardTransitions {
+		_, err = tx.Exec(`INSERT INTO card_transition (card_id,issue_url,from_column,to_column,moved_at) VALUES (?,?,?,?,?)`,
+			t.CardID, t.IssueURL, t.From, t.To, t.MovedAt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range s.BotActions {
+		_, err = tx.Exec(`INSERT INTO bot_action (created_at,kind,target,detail) VALUES (?,?,?,?)`,
+			a.CreatedAt, a.Kind, a.Target, a.Detail)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range s.JobRuns {
+		_, err = tx.Exec(`INSERT INTO job_run (name,last_run,duration_ms,error) VALUES (?,?,?,?)`,
+			r.Name, r.LastRun, r.Duration, r.Error)
+		if err != nil {
+			return err
+		}
+	}
+	for _, d := range s.WebhookDeliveries {
+		_, err = tx.Exec(`INSERT INTO webhook_delivery (id,event,received_at) VALUES (?,?,?)`,
+			d.ID, d.Event, d.ReceivedAt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, w := range s.QueuedWebhooks {
+		_, err = tx.Exec(`INSERT INTO webhook_queue (delivery,event,payload,received_at) VALUES (?,?,?,?)`,
+			w.Delivery, w.Event, w.Payload, w.ReceivedAt)
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range s.FlowSnapshots {
+		_, err = tx.Exec(`INSERT INTO flow_snapshot (date,position,column_name,count) VALUES (?,?,?,?)`,
+			f.Date, f.Position, f.Column, f.Count)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range s.BurndownSnapshots {
+		_, err = tx.Exec(`INSERT INTO burndown_snapshot (date,remaining,with_deadline,overdue) VALUES (?,?,?,?)`,
+			b.Date, b.Remaining, b.WithDeadline, b.Overdue)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func writeState(out io.Writer, s *botState) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func readState(in io.Reader) (*botState, error) {
+	var s botState
+	err := json.NewDecoder(in).Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	if s.SchemaVersion > latestSchemaVersion() {
+		return nil, fmt.Errorf("the state is exported from schema version %d, newer than %d supported by this kanbanmgr",
+			s.SchemaVersion, latestSchemaVersion())
+	}
+	return &s, nil
+}
+
+// runExport implements the export subcommand, which dumps the bot state to
+// a JSON file or stdout.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	registerConfigFlag(flags)
+	output := flags.String("o", "-", "the output file, - for stdout")
+	flags.Parse(args)
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	s, err := exportState(time.Now())
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		return writeState(os.Stdout, s)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	err = writeState(f, s)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runImport implements the import subcommand, which restores the bot state
+// exported by the export subcommand.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	registerConfigFlag(flags)
+	replace := flags.Bool("replace", false, "clear the current state before importing")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: %s import [-config kanbanmgr.yml] [-replace] state.json|-", os.Args[0])
+	}
+
+	in := os.Stdin
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	s, err := readState(in)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = importState(s, *replace)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d deadlines, %d card transitions, %d bot actions\n",
+		len(s.Issues), len(s.CardTransitions), len(s.BotActions))
+	return nil
+}
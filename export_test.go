@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	const issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	now := time.Date(2018, 12, 3, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 100, date: now, url: issueURL, directive: "3", timezone: "Asia/Tokyo"}))
+	assert.Nil(t, addDeadlineReminder(100, "2018-12-03"))
+	// the reminder of a deleted deadline.
+	assert.Nil(t, addDeadlineReminder(200, "2018-12-01"))
+	assert.Nil(t, addCardTransition(&cardTransition{CardID: 7, IssueURL: issueURL, To: "开发", MovedAt: now}))
+	assert.Nil(t, recordJobRun("delay-check", now, time.Second, nil))
+	_, err := recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	_, err = queueDelivery("d2", "ping", []byte(`{"zen":"Design for failure."}`))
+	assert.Nil(t, err)
+
+	s, err := exportState(now)
+	assert.Nil(t, err)
+	assert.Equal(t, latestSchemaVersion(), s.SchemaVersion)
+	assert.Len(t, s.Issues, 1)
+	assert.Equal(t, "2018-12-03", s.Issues[issueURL].Date)
+	assert.Equal(t, []string{"2018-12-03"}, s.Issues[issueURL].Reminded)
+	assert.Len(t, s.CardTransitions, 1)
+	assert.Len(t, s.QueuedWebhooks, 1)
+
+	var exported bytes.Buffer
+	assert.Nil(t, writeState(&exported, s))
+
+	assert.Nil(t, initDB(":memory:"))
+	s, err = readState(bytes.NewReader(exported.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, importState(s, false))
+	assert.NotNil(t, importState(s, false))
+	assert.Nil(t, importState(s, true))
+
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), issueDeadline.id)
+	assert.Equal(t, "Asia/Tokyo", issueDeadline.timezone)
+	reminded, err := isDeadlineReminded(100, "2018-12-03")
+	assert.Nil(t, err)
+	assert.True(t, reminded)
+
+	s, err = exportState(now)
+	assert.Nil(t, err)
+	var reexported bytes.Buffer
+	assert.Nil(t, writeState(&reexported, s))
+	assert.JSONEq(t, exported.String(), reexported.String())
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+type fakeProject struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type fakeColumn struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Name      string `json:"name"`
+}
+
+type fakeCard struct {
+	ID         int64  `json:"id"`
+	ColumnID   int64  `json:"column_id"`
+	ContentURL string `json:"content_url"`
+	Note       string `json:"note"`
+}
+
+type fakeTeam struct {
+	ID      int64    `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// fakeBoard simulates the part of the Github API used by this app, it serves
+// the board described in a json file and prints the mutations instead of
+// doing them.
+type fakeBoard struct {
+	mu       sync.Mutex
+	out      io.Writer
+	Projects []*fakeProject  `json:"projects"`
+	Columns  []*fakeColumn   `json:"columns"`
+	Cards    []*fakeCard     `json:"cards"`
+	Issues   []*github.Issue `json:"issues"`
+	Teams    []*fakeTeam     `json:"teams"`
+}
+
+func loadFakeBoard(filename string, out io.Writer) (*fakeBoard, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	board := &fakeBoard{out: out}
+	err = json.Unmarshal(data, board)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse board file %q: %v", filename, err)
+	}
+	return board, nil
+}
+
+type fakeRoute struct {
+	method  string
+	path    *regexp.Regexp
+	handler func(b *fakeBoard, r *http.Request, match []string) (int, interface{})
+}
+
+var fakeRoutes = []fakeRoute{
+	{"GET", regexp.MustCompile(`^/orgs/[^/]+/projects$`), (*fakeBoard).listProjects},
+	{"GET", regexp.MustCompile(`^/projects/(\d+)/columns$`), (*fakeBoard).listColumns},
+	{"GET", regexp.MustCompile(`^/projects/columns/(\d+)/cards$`), (*fakeBoard).listCards},
+	{"POST", regexp.MustCompile(`^/projects/columns/cards/(\d+)/moves$`), (*fakeBoard).moveCard},
+	{"GET", regexp.MustCompile(`^/orgs/[^/]+/teams$`), (*fakeBoard).listTeams},
+	{"GET", regexp.MustCompile(`^/teams/(\d+)/members$`), (*fakeBoard).listTeamMembers},
+	{"GET", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/issues/(\d+)$`), (*fakeBoard).getIssue},
+	{"PATCH", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/issues/(\d+)$`), (*fakeBoard).editIssue},
+	{"POST", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/issues/(\d+)/labels$`), (*fakeBoard).addLabels},
+	{"DELETE", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/issues/(\d+)/labels/([^/]+)$`), (*fakeBoard).removeLabel},
+	{"POST", regexp.MustCompile(`^/repos/([^/]+)/([^/]+)/issues/(\d+)/comments$`), (*fakeBoard).createComment},
+}
+
+func (b *fakeBoard) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, route := range fakeRoutes {
+		if route.method != r.Method {
+			continue
+		}
+		match := route.path.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			continue
+		}
+
+		status, body := route.handler(b, r, match)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		json.NewEncoder(rw).Encode(body)
+		return
+	}
+
+	fmt.Fprintf(b.out, "unhandled request %s %s\n", r.Method, r.URL.Path)
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte(`{"message":"Not Found"}`))
+}
+
+// newFakeBoardClient returns a client talking to the fake board described
+// in the file, the returned function stops the board.
+func newFakeBoardClient(filename string, out io.Writer) (*github.Client, func(), error) {
+	board, err := loadFakeBoard(filename, out)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, stop := board.newClient()
+	return c, stop, nil
+}
+
+// newClient starts serving the board and returns a client talking to it,
+// the returned function stops the server.
+func (b *fakeBoard) newClient() (*github.Client, func()) {
+	server := httptest.NewServer(b)
+	c := github.NewClient(nil)
+	c.BaseURL, _ = url.Parse(server.URL + "/")
+	return c, server.Close
+}
+
+var notFound = map[string]string{"message": "Not Found"}
+
+func (b *fakeBoard) listProjects(r *http.Request, match []string) (int, interface{}) {
+	var ret []*github.Project
+	for _, p := range b.Projects {
+		ret = append(ret, &github.Project{ID: github.Int64(p.ID), Name: github.String(p.Name)})
+	}
+	return http.StatusOK, ret
+}
+
+func (b *fakeBoard) listColumns(r *http.Request, match []string) (int, interface{}) {
+	projectID, _ := strconv.ParseInt(match[1], 10, 64)
+	var ret []*github.ProjectColumn
+	for _, col := range b.Columns {
+		if col.ProjectID == projectID {
+			ret = append(ret, &github.ProjectColumn{ID: github.Int64(col.ID), Name: github.String(col.Name)})
+		}
+	}
+	return http.StatusOK, ret
+}
+
+func (b *fakeBoard) listCards(r *http.Request, match []string) (int, interface{}) {
+	columnID, _ := strconv.ParseInt(match[1], 10, 64)
+	var ret []*github.ProjectCard
+	for _, card := range b.Cards {
+		if card.ColumnID == columnID {
+			ret = append(ret, b.projectCard(card))
+		}
+	}
+	return http.StatusOK, ret
+}
+
+func (b *fakeBoard) projectCard(card *fakeCard) *github.ProjectCard {
+	ret := &github.ProjectCard{
+		ID:       github.Int64(card.ID),
+		ColumnID: github.Int64(card.ColumnID),
+	}
+	if card.ContentURL != "" {
+		ret.ContentURL = github.String(card.ContentURL)
+	}
+	if card.Note != "" {
+		ret.Note = github.String(card.Note)
+	}
+	return ret
+}
+
+func (b *fakeBoard) findColumn(id int64) *fakeColumn {
+	for _, col := range b.Columns {
+		if col.ID == id {
+			return col
+		}
+	}
+	return nil
+}
+
+func (b *fakeBoard) moveCard(r *http.Request, match []string) (int, interface{}) {
+	cardID, _ := strconv.ParseInt(match[1], 10, 64)
+	var opts github.ProjectCardMoveOptions
+	err := json.NewDecoder(r.Body).Decode(&opts)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	column := b.findColumn(opts.ColumnID)
+	if column == nil {
+		return http.StatusNotFound, notFound
+	}
+	for _, card := range b.Cards {
+		if card.ID == cardID {
+			fmt.Fprintf(b.out, "move card %d to column %q\n", cardID, column.Name)
+			card.ColumnID = column.ID
+			return http.StatusCreated, struct{}{}
+		}
+	}
+	return http.StatusNotFound, notFound
+}
+
+func (b *fakeBoard) listTeams(r *http.Request, match []string) (int, interface{}) {
+	var ret []*github.Team
+	for _, t := range b.Teams {
+		ret = append(ret, &github.Team{ID: github.Int64(t.ID), Name: github.String(t.Name)})
+	}
+	return http.StatusOK, ret
+}
+
+func (b *fakeBoard) listTeamMembers(r *http.Request, match []string) (int, interface{}) {
+	teamID, _ := strconv.ParseInt(match[1], 10, 64)
+	var ret []*github.User
+	for _, t := range b.Teams {
+		if t.ID == teamID {
+			for _, login := range t.Members {
+				ret = append(ret, &github.User{Login: github.String(login)})
+			}
+		}
+	}
+	return http.StatusOK, ret
+}
+
+func (b *fakeBoard) findIssue(owner, repo, num string) *github.Issue {
+	for _, issue := range b.Issues {
+		o, r, n, err := parseIssueURL(issue.GetURL())
+		if err == nil && o == owner && r == repo && strconv.Itoa(n) == num {
+			return issue
+		}
+	}
+	return nil
+}
+
+func (b *fakeBoard) getIssue(r *http.Request, match []string) (int, interface{}) {
+	issue := b.findIssue(match[1], match[2], match[3])
+	if issue == nil {
+		return http.StatusNotFound, notFound
+	}
+	return http.StatusOK, issue
+}
+
+func (b *fakeBoard) editIssue(r *http.Request, match []string) (int, interface{}) {
+	issue := b.findIssue(match[1], match[2], match[3])
+	if issue == nil {
+		return http.StatusNotFound, notFound
+	}
+	var req github.IssueRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	if req.Title != nil {
+		fmt.Fprintf(b.out, "edit title of %s/%s#%s: %s\n", match[1], match[2], match[3], req.GetTitle())
+		issue.Title = req.Title
+	}
+	return http.StatusOK, issue
+}
+
+func (b *fakeBoard) addLabels(r *http.Request, match []string) (int, interface{}) {
+	issue := b.findIssue(match[1], match[2], match[3])
+	if issue == nil {
+		return http.StatusNotFound, notFound
+	}
+	var names []string
+	err := json.NewDecoder(r.Body).Decode(&names)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(b.out, "add label %q to %s/%s#%s\n", name, match[1], match[2], match[3])
+		if !hasLabel(issue, name) {
+			issue.Labels = append(issue.Labels, github.Label{Name: github.String(name)})
+		}
+	}
+	return http.StatusOK, issue.Labels
+}
+
+func (b *fakeBoard) removeLabel(r *http.Request, match []string) (int, interface{}) {
+	issue := b.findIssue(match[1], match[2], match[3])
+	if issue == nil {
+		return http.StatusNotFound, notFound
+	}
+	name, _ := url.PathUnescape(match[4])
+
+	for i, label := range issue.Labels {
+		if label.GetName() == name {
+			fmt.Fprintf(b.out, "remove label %q from %s/%s#%s\n", name, match[1], match[2], match[3])
+			issue.Labels = append(issue.Labels[:i], issue.Labels[i+1:]...)
+			return http.StatusOK, issue.Labels
+		}
+	}
+	return http.StatusNotFound, notFound
+}
+
+func (b *fakeBoard) createComment(r *http.Request, match []string) (int, interface{}) {
+	if b.findIssue(match[1], match[2], match[3]) == nil {
+		return http.StatusNotFound, notFound
+	}
+	var comment github.IssueComment
+	err := json.NewDecoder(r.Body).Decode(&comment)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"message": err.Error()}
+	}
+
+	fmt.Fprintf(b.out, "comment on %s/%s#%s: %s\n", match[1], match[2], match[3], comment.GetBody())
+	return http.StatusCreated, &comment
+}
+
+func hasLabel(issue *github.Issue, name string) bool {
+	for _, label := range issue.Labels {
+		if label.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	chartCFD      = "cfd"
+	chartBurndown = "burndown"
+)
+
+// takeFlowSnapshot records the count of the cards in every column of the
+// board, and the remaining issues in the target columns of today.
+func takeFlowSnapshot() error {
+	c := config()
+	date := formatDate(time.Now().In(c.boardLocation()))
+
+	cardsLock.Lock()
+	columns := append([]*github.ProjectColumn(nil), metaColumns...)
+	cardsLock.Unlock()
+
+	for i, col := range columns {
+		cards, err := getColumnCards(col)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO flow_snapshot (date,position,column_name,count) VALUES (?,?,?,?)
+			ON CONFLICT (date,column_name) DO UPDATE SET position = excluded.position, count = excluded.count`,
+			date, i, col.GetName(), len(cards))
+		if err != nil {
+			return err
+		}
+	}
+
+	issues, err := getTrackedIssues()
+	if err != nil {
+		return err
+	}
+	day := countRemaining(date, issues, time.Now().In(c.boardLocation()))
+	_, err = db.Exec(`INSERT INTO burndown_snapshot (date,remaining,with_deadline,overdue) VALUES (?,?,?,?)
+		ON CONFLICT (date) DO UPDATE SET remaining = excluded.remaining, with_deadline = excluded.with_deadline, overdue = excluded.overdue`,
+		day.Date, day.Remaining, day.WithDeadline, day.Overdue)
+	return err
+}
+
+// cfdData is the cumulative flow, Counts of every day are in the order of
+// Columns.
+type cfdData struct {
+	Columns []string  `json:"columns"`
+	Days    []*cfdDay `json:"days"`
+}
+
+type cfdDay struct {
+	Date   string `json:"date"`
+	Counts []int  `json:"counts"`
+}
+
+// flowSnapshot is the count of the cards in a column at the end of a day.
+type flowSnapshot struct {
+	date     string
+	position int
+	column   string
+	count    int
+}
+
+// getCFDData builds the cumulative flow of the days since the date from the
+// snapshots and the transitions of the cards.
+func getCFDData(since string) (*cfdData, error) {
+	rows, err := db.Query(`SELECT date,position,column_name,count FROM flow_snapshot ORDER BY date, position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []*flowSnapshot
+	for rows.Next() {
+		s := &flowSnapshot{}
+		err = rows.Scan(&s.date, &s.position, &s.column, &s.count)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	transitions, err := listCardTransitions()
+	if err != nil {
+		return nil, err
+	}
+
+	cardsLock.Lock()
+	var columns []string
+	for _, col := range metaColumns {
+		columns = append(columns, col.GetName())
+	}
+	cardsLock.Unlock()
+
+	return buildCFD(snapshots, transitions, columns, config().boardLocation(), since), nil
+}
+
+// buildCFD counts the cards in every column at the end of every day since
+// the date. The days with a snapshot take it. The days before a snapshot are
+// reconstructed backward from it by undoing the transitions of the next day,
+// and the days after the last one by replaying the transitions, so the days
+// before the snapshots were taken are covered by the recorded history. The
+// columns are in the order of the latest snapshot, then of the board.
+func buildCFD(snapshots []*flowSnapshot, transitions []*cardTransition, boardColumns []string, loc *time.Location, since string) *cfdData {
+	positions := make(map[string]int)
+	byDate := make(map[string]map[string]int)
+	for _, s := range snapshots {
+		positions[s.column] = s.position
+		if byDate[s.date] == nil {
+			byDate[s.date] = make(map[string]int)
+		}
+		byDate[s.date][s.column] = s.count
+	}
+
+	// the net change of the columns on each day.
+	changes := make(map[string]map[string]int)
+	var first, last string
+	addDate := func(date string) {
+		if first == "" || date < first {
+			first = date
+		}
+		if date > last {
+			last = date
+		}
+	}
+	for date := range byDate {
+		addDate(date)
+	}
+	for _, t := range transitions {
+		date := formatDate(t.MovedAt.In(loc))
+		addDate(date)
+		if changes[date] == nil {
+			changes[date] = make(map[string]int)
+		}
+		if t.From != "" {
+			changes[date][t.From]--
+		}
+		if t.To != "" {
+			changes[date][t.To]++
+		}
+	}
+
+	data := &cfdData{Columns: []string{}, Days: []*cfdDay{}}
+	if first == "" {
+		return data
+	}
+
+	seen := make(map[string]bool)
+	addColumn := func(column string) {
+		if column != "" && !seen[column] {
+			seen[column] = true
+			data.Columns = append(data.Columns, column)
+		}
+	}
+	for column := range positions {
+		addColumn(column)
+	}
+	sort.Slice(data.Columns, func(i, j int) bool {
+		pi, pj := positions[data.Columns[i]], positions[data.Columns[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		return data.Columns[i] < data.Columns[j]
+	})
+	for _, column := range boardColumns {
+		addColumn(column)
+	}
+	var others []string
+	for _, day := range changes {
+		for column := range day {
+			if !seen[column] {
+				others = append(others, column)
+			}
+		}
+	}
+	sort.Strings(others)
+	for _, column := range others {
+		addColumn(column)
+	}
+
+	var dates []string
+	start, _ := time.Parse(layoutYMD, first)
+	end, _ := time.Parse(layoutYMD, last)
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, formatDate(d))
+	}
+
+	// the anchor is the last snapshot, or the day before the history.
+	counts := make([]map[string]int, len(dates))
+	anchor := -1
+	for i, date := range dates {
+		if byDate[date] != nil {
+			anchor = i
+		}
+	}
+	prev := make(map[string]int)
+	if anchor >= 0 {
+		prev = byDate[dates[anchor]]
+		counts[anchor] = prev
+	}
+	for i := anchor + 1; i < len(dates); i++ {
+		day := make(map[string]int)
+		for _, column := range data.Columns {
+			day[column] = prev[column] + changes[dates[i]][column]
+		}
+		counts[i] = day
+		prev = day
+	}
+	for i := anchor - 1; i >= 0; i-- {
+		if snapshot := byDate[dates[i]]; snapshot != nil {
+			counts[i] = snapshot
+			continue
+		}
+		day := make(map[string]int)
+		for _, column := range data.Columns {
+			day[column] = counts[i+1][column] - changes[dates[i+1]][column]
+		}
+		counts[i] = day
+	}
+
+	for i, date := range dates {
+		if date < since {
+			continue
+		}
+		day := &cfdDay{Date: date, Counts: make([]int, len(data.Columns))}
+		for j, column := range data.Columns {
+			if n := counts[i][column]; n > 0 {
+				day.Counts[j] = n
+			}
+		}
+		data.Days = append(data.Days, day)
+	}
+	return data
+}
+
+// burndownData is the remaining issues of the past days and the planned
+// remaining of the coming days if every issue is done by its deadline.
+type burndownData struct {
+	Actual  []*burndownDay `json:"actual"`
+	Planned []*plannedDay  `json:"planned"`
+}
+
+type burndownDay struct {
+	Date         string `json:"date"`
+	Remaining    int    `json:"remaining"`
+	WithDeadline int    `json:"with_deadline"`
+	Overdue      int    `json:"overdue"`
+}
+
+type plannedDay struct {
+	Date      string `json:"date"`
+	Remaining int    `json:"remaining"`
+}
+
+func countRemaining(date string, issues []*trackedIssue, now time.Time) *burndownDay {
+	day := &burndownDay{Date: date}
+	for _, issue := range issues {
+		if issue.State != "open" {
+			continue
+		}
+		day.Remaining++
+		if issue.hasDeadline() {
+			day.WithDeadline++
+			if issue.isOverdueAt(now) {
+				day.Overdue++
+			}
+		}
+	}
+	return day
+}
+
+// planBurndown returns the remaining issues from today to the last deadline,
+// an issue is planned to be done after its deadline, now must be in the board
+// timezone.
+func planBurndown(issues []*trackedIssue, now time.Time) []*plannedDay {
+	today := plainDate(now)
+
+	var deadlines []time.Time
+	noDeadline := 0
+	last := today
+	for _, issue := range issues {
+		if issue.State != "open" {
+			continue
+		}
+		if !issue.hasDeadline() {
+			noDeadline++
+			continue
+		}
+		deadline := plainDate(issue.Deadline)
+		deadlines = append(deadlines, deadline)
+		if deadline.After(last) {
+			last = deadline
+		}
+	}
+
+	ret := []*plannedDay{}
+	for d := today; !d.After(last.AddDate(0, 0, 1)); d = d.AddDate(0, 0, 1) {
+		day := &plannedDay{Date: formatDate(d), Remaining: noDeadline}
+		for _, deadline := range deadlines {
+			if !deadline.Before(d) {
+				day.Remaining++
+			}
+		}
+		ret = append(ret, day)
+	}
+	return ret
+}
+
+func getBurndownData(since string) (*burndownData, error) {
+	data := &burndownData{Actual: []*burndownDay{}}
+	rows, err := db.Query(`SELECT date,remaining,with_deadline,overdue FROM burndown_snapshot
+		WHERE date >= ? ORDER BY date`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		day := &burndownDay{}
+		err = rows.Scan(&day.Date, &day.Remaining, &day.WithDeadline, &day.Overdue)
+		if err != nil {
+			return nil, err
+		}
+		data.Actual = append(data.Actual, day)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	issues, err := getTrackedIssues()
+	if err != nil {
+		return nil, err
+	}
+	data.Planned = planBurndown(issues, time.Now().In(config().boardLocation()))
+	return data, nil
+}
+
+func (d *cfdData) writeCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write(append([]string{"date"}, d.Columns...))
+	for _, day := range d.Days {
+		record := []string{day.Date}
+		for _, count := range day.Counts {
+			record = append(record, strconv.Itoa(count))
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// writeCSV writes the actual and planned days in one table, the cells of the
+// days without data are empty.
+func (d *burndownData) writeCSV(out io.Writer) error {
+	actual := make(map[string]*burndownDay)
+	planned := make(map[string]*plannedDay)
+	var dates []string
+	for _, day := range d.Actual {
+		actual[day.Date] = day
+		dates = append(dates, day.Date)
+	}
+	for _, day := range d.Planned {
+		planned[day.Date] = day
+		if actual[day.Date] == nil {
+			dates = append(dates, day.Date)
+		}
+	}
+	sort.Strings(dates)
+
+	w := csv.NewWriter(out)
+	w.Write([]string{"date", "remaining", "with_deadline", "overdue", "planned"})
+	for _, date := range dates {
+		record := []string{date, "", "", "", ""}
+		if day := actual[date]; day != nil {
+			record[1] = strconv.Itoa(day.Remaining)
+			record[2] = strconv.Itoa(day.WithDeadline)
+			record[3] = strconv.Itoa(day.Overdue)
+		}
+		if day := planned[date]; day != nil {
+			record[4] = strconv.Itoa(day.Remaining)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+var chartColors = []string{"#0366d6", "#28a745", "#f66a0a", "#6f42c1", "#d73a49", "#ffd33d", "#959da5", "#005cc5"}
+
+// chartSeries is a line of the chart, NaN values are the days without data.
+type chartSeries struct {
+	Name   string
+	Values []float64
+	Dashed bool
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	chartLeft   = 50
+	chartRight  = 160
+	chartTop    = 40
+	chartBottom = 40
+)
+
+// writeChartSVG draws the series over the dates, stacked draws them as the
+// areas stacked from the last series up.
+func writeChartSVG(out io.Writer, title string, dates []string, series []*chartSeries, stacked bool) error {
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+
+	// the tops of the stacked areas.
+	tops := make([][]float64, len(series))
+	for i := len(series) - 1; i >= 0; i-- {
+		tops[i] = make([]float64, len(dates))
+		for j := range dates {
+			v := series[i].Values[j]
+			if stacked {
+				if math.IsNaN(v) {
+					v = 0
+				}
+				if i+1 < len(series) {
+					v += tops[i+1][j]
+				}
+			}
+			tops[i][j] = v
+		}
+	}
+
+	max := 0.0
+	for _, values := range tops {
+		for _, v := range values {
+			if v > max {
+				max = v
+			}
+		}
+	}
+	step := math.Max(1, math.Ceil(max/5))
+	max = step * 5
+
+	x := func(i int) float64 {
+		if len(dates) < 2 {
+			return chartLeft + plotWidth/2
+		}
+		return chartLeft + plotWidth*float64(i)/float64(len(dates)-1)
+	}
+	y := func(v float64) float64 {
+		return chartTop + plotHeight - plotHeight*v/max
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#fff"/>`+"\n")
+	fmt.Fprintf(&b, `<text x="%d" y="24" font-size="16">%s</text>`+"\n", chartLeft, html.EscapeString(title))
+
+	for v := 0.0; v <= max; v += step {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#e1e4e8"/>`+"\n",
+			chartLeft, y(v), chartLeft+plotWidth, y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%g</text>`+"\n", chartLeft-6, y(v)+4, v)
+	}
+	labelEvery := len(dates)/8 + 1
+	for i, date := range dates {
+		if i%labelEvery != 0 && i != len(dates)-1 {
+			continue
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+			x(i), chartHeight-chartBottom+18, date[5:])
+	}
+
+	for i, s := range series {
+		color := chartColors[i%len(chartColors)]
+		if stacked && len(dates) > 0 {
+			var points []string
+			for j := range dates {
+				points = append(points, fmt.Sprintf("%.1f,%.1f", x(j), y(tops[i][j])))
+			}
+			for j := len(dates) - 1; j >= 0; j-- {
+				bottom := 0.0
+				if i+1 < len(series) {
+					bottom = tops[i+1][j]
+				}
+				points = append(points, fmt.Sprintf("%.1f,%.1f", x(j), y(bottom)))
+			}
+			fmt.Fprintf(&b, `<polygon points="%s" fill="%s" fill-opacity="0.8" stroke="%s"/>`+"\n",
+				strings.Join(points, " "), color, color)
+		} else {
+			// a polyline for every run of the days with data.
+			var points []string
+			flush := func() {
+				if len(points) > 0 {
+					dash := ""
+					if s.Dashed {
+						dash = ` stroke-dasharray="6,4"`
+					}
+					fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"%s/>`+"\n",
+						strings.Join(points, " "), color, dash)
+				}
+				points = nil
+			}
+			for j, v := range tops[i] {
+				if math.IsNaN(v) {
+					flush()
+					continue
+				}
+				points = append(points, fmt.Sprintf("%.1f,%.1f", x(j), y(v)))
+			}
+			flush()
+		}
+
+		legendY := chartTop + 20*i
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%d" width="12" height="12" fill="%s"/>`+"\n",
+			chartLeft+plotWidth+16, legendY, color)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d">%s</text>`+"\n",
+			chartLeft+plotWidth+34, legendY+11, html.EscapeString(s.Name))
+	}
+
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// writeSVG draws the cumulative flow, the columns at the end of the board
+// are at the bottom.
+func (d *cfdData) writeSVG(out io.Writer) error {
+	var dates []string
+	for _, day := range d.Days {
+		dates = append(dates, day.Date)
+	}
+	var series []*chartSeries
+	for i, column := range d.Columns {
+		s := &chartSeries{Name: column}
+		for _, day := range d.Days {
+			s.Values = append(s.Values, float64(day.Counts[i]))
+		}
+		series = append(series, s)
+	}
+	return writeChartSVG(out, config().Board.Project+" 累积流图", dates, series, true)
+}
+
+func (d *burndownData) writeSVG(out io.Writer) error {
+	index := make(map[string]int)
+	var dates []string
+	for _, day := range d.Actual {
+		dates = append(dates, day.Date)
+	}
+	for _, day := range d.Planned {
+		dates = append(dates, day.Date)
+	}
+	sort.Strings(dates)
+	unique := dates[:0]
+	for _, date := range dates {
+		if _, ok := index[date]; !ok {
+			index[date] = len(unique)
+			unique = append(unique, date)
+		}
+	}
+	dates = unique
+
+	newSeries := func(name string, dashed bool) *chartSeries {
+		s := &chartSeries{Name: name, Values: make([]float64, len(dates)), Dashed: dashed}
+		for i := range s.Values {
+			s.Values[i] = math.NaN()
+		}
+		return s
+	}
+	remaining := newSeries("剩余", false)
+	overdue := newSeries("已延期", false)
+	planned := newSeries("按截止日期", true)
+	for _, day := range d.Actual {
+		remaining.Values[index[day.Date]] = float64(day.Remaining)
+		overdue.Values[index[day.Date]] = float64(day.Overdue)
+	}
+	for _, day := range d.Planned {
+		planned.Values[index[day.Date]] = float64(day.Remaining)
+	}
+	return writeChartSVG(out, config().Board.Project+" 燃尽图", dates, []*chartSeries{remaining, overdue, planned}, false)
+}
+
+// flowExport is the data of a chart which can be exported.
+type flowExport interface {
+	writeCSV(out io.Writer) error
+	writeSVG(out io.Writer) error
+}
+
+func getFlowExport(chart string, since string) (flowExport, error) {
+	switch chart {
+	case chartCFD:
+		return getCFDData(since)
+	case chartBurndown:
+		return getBurndownData(since)
+	}
+	return nil, fmt.Errorf("unknown chart %q, should be cfd or burndown", chart)
+}
+
+// writeFlowExport writes the chart data in the format, which is one of
+// json, csv and svg.
+func writeFlowExport(out io.Writer, data flowExport, format string) error {
+	switch format {
+	case "json", "":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	case "csv":
+		return data.writeCSV(out)
+	case "svg":
+		return data.writeSVG(out)
+	}
+	return fmt.Errorf("unknown format %q, should be json, csv or svg", format)
+}
+
+var flowContentTypes = map[string]string{
+	"json": "application/json; charset=utf-8",
+	"csv":  "text/csv; charset=utf-8",
+	"svg":  "image/svg+xml",
+}
+
+// serveFlow serves the chart in the format unless the format query
+// parameter is given, with the since query parameter.
+func serveFlow(chart string, defaultFormat string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = defaultFormat
+		}
+		contentType, ok := flowContentTypes[format]
+		if !ok {
+			http.Error(rw, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+
+		data, err := getFlowExport(chart, query.Get("since"))
+		if err != nil {
+			logrus.Warningf("failed to get %s data: %v", chart, err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", contentType)
+		err = writeFlowExport(rw, data, format)
+		if err != nil {
+			logrus.Warningf("failed to write %s data: %v", chart, err)
+		}
+	}
+}
+
+// runFlow implements the flow subcommand, which exports the cumulative flow
+// or the burndown.
+func runFlow(args []string) error {
+	flags := flag.NewFlagSet("flow", flag.ExitOnError)
+	registerConfigFlag(flags)
+	format := flags.String("format", "csv", "output format, json, csv or svg")
+	since := flags.String("since", "", "only export the days since the date, e.g. 2018-12-01")
+	output := flags.String("o", "", "write to the file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: kanbanmgr flow [flags] cfd|burndown")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected one chart, cfd or burndown")
+	}
+	chart := flags.Arg(0)
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	problems := c.validateBoard()
+	if chart == chartBurndown {
+		// the planned burndown needs the deadlines of the issues on the board.
+		problems = append(problems, c.validateGithub()...)
+	}
+	err = joinProblems(problems)
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	setConfig(c)
+
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	if chart == chartBurndown {
+		err = initGithubClient()
+		if err != nil {
+			return err
+		}
+		err = PrepareKanbanMetadata()
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := getFlowExport(chart, *since)
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return writeFlowExport(out, data, *format)
+}
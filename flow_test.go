@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanBurndown(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	now := time.Date(2018, 12, 4, 9, 0, 0, 0, loc)
+	day := func(d int) time.Time {
+		return time.Date(2018, 12, d, 0, 0, 0, 0, loc)
+	}
+
+	issues := []*trackedIssue{
+		{Ref: "o/r#1", State: "open", Deadline: day(3)},
+		{Ref: "o/r#2", State: "open", Deadline: day(5)},
+		{Ref: "o/r#3", State: "open", Deadline: day(6)},
+		{Ref: "o/r#4", State: "open"},
+		{Ref: "o/r#5", State: "closed", Deadline: day(6)},
+	}
+
+	planned := planBurndown(issues, now)
+	var got []string
+	for _, d := range planned {
+		got = append(got, fmt.Sprintf("%s:%d", d.Date, d.Remaining))
+	}
+	assert.Equal(t, []string{"2018-12-04:3", "2018-12-05:3", "2018-12-06:2", "2018-12-07:1"}, got)
+
+	remaining := countRemaining("2018-12-04", issues, now)
+	assert.Equal(t, 4, remaining.Remaining)
+	assert.Equal(t, 3, remaining.WithDeadline)
+	assert.Equal(t, 1, remaining.Overdue)
+}
+
+func TestFlowExport(t *testing.T) {
+	data := &cfdData{
+		Columns: []string{"开发", "测试", "A&B"},
+		Days: []*cfdDay{
+			{Date: "2018-12-03", Counts: []int{3, 1, 0}},
+			{Date: "2018-12-04", Counts: []int{2, 1, 1}},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeFlowExport(&buf, data, "csv"))
+	assert.Equal(t, "date,开发,测试,A&B\n2018-12-03,3,1,0\n2018-12-04,2,1,1\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(t, writeFlowExport(&buf, data, "svg"))
+	assert.Contains(t, buf.String(), "A&amp;B")
+	dec := xml.NewDecoder(strings.NewReader(buf.String()))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if err != nil {
+			break
+		}
+	}
+
+	assert.NotNil(t, writeFlowExport(&buf, data, "png"))
+}
+
+func TestBuildCFD(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	at := func(d, h int) time.Time {
+		return time.Date(2018, 12, d, h, 0, 0, 0, loc)
+	}
+
+	// the snapshots are only taken since the 4th.
+	snapshots := []*flowSnapshot{
+		{date: "2018-12-04", position: 0, column: "开发", count: 1},
+		{date: "2018-12-04", position: 1, column: "测试", count: 2},
+	}
+	transitions := []*cardTransition{
+		{CardID: 1, To: "开发", MovedAt: at(2, 10)},
+		{CardID: 2, To: "开发", MovedAt: at(2, 11)},
+		{CardID: 3, To: "开发", MovedAt: at(3, 9)},
+		{CardID: 1, From: "开发", To: "测试", MovedAt: at(3, 15)},
+		// on the 4th in the timezone of the board.
+		{CardID: 2, From: "开发", To: "测试", MovedAt: time.Date(2018, 12, 3, 17, 0, 0, 0, time.UTC)},
+		{CardID: 1, From: "测试", To: "完成", MovedAt: at(5, 10)},
+		{CardID: 3, From: "开发", MovedAt: at(6, 10)},
+	}
+
+	data := buildCFD(snapshots, transitions, []string{"开发", "测试", "完成"}, loc, "")
+	assert.Equal(t, []string{"开发", "测试", "完成"}, data.Columns)
+	var got []string
+	for _, d := range data.Days {
+		got = append(got, fmt.Sprintf("%s:%v", d.Date, d.Counts))
+	}
+	assert.Equal(t, []string{
+		"2018-12-02:[2 0 0]",
+		"2018-12-03:[2 1 0]",
+		"2018-12-04:[1 2 0]",
+		"2018-12-05:[1 1 1]",
+		"2018-12-06:[0 1 1]",
+	}, got)
+
+	data = buildCFD(snapshots, transitions, nil, loc, "2018-12-05")
+	assert.Equal(t, []string{"开发", "测试", "完成"}, data.Columns)
+	assert.Len(t, data.Days, 2)
+
+	// without snapshots the history is replayed.
+	data = buildCFD(nil, transitions[:3], []string{"开发"}, loc, "")
+	assert.Len(t, data.Days, 2)
+	assert.Equal(t, []int{3}, data.Days[1].Counts)
+
+	data = buildCFD(nil, nil, []string{"开发"}, loc, "")
+	assert.Empty(t, data.Days)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	initRetryMin = 5 * time.Second
+	initRetryMax = 5 * time.Minute
+)
+
+// health keeps the times the metadata are loaded, which are zero until the
+// first successful load.
+var health struct {
+	mu            sync.Mutex
+	kanbanLoaded  time.Time
+	teamsLoaded   time.Time
+	lastInitError error
+}
+
+func markKanbanLoaded() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.kanbanLoaded = time.Now()
+}
+
+func markTeamsLoaded() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.teamsLoaded = time.Now()
+}
+
+// isMetadataLoaded reports whether both the kanban and teams metadata have
+// been loaded, the bot can't handle the events correctly before that.
+func isMetadataLoaded() bool {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	return !health.kanbanLoaded.IsZero() && !health.teamsLoaded.IsZero()
+}
+
+// initGithubDataWithRetry loads the metadata until it succeeds, so the bot
+// starts in the degraded mode when Github is unreachable instead of exiting.
+func initGithubDataWithRetry() {
+	delay := initRetryMin
+	for {
+		err := updateMetadata()
+		health.mu.Lock()
+		health.lastInitError = err
+		health.mu.Unlock()
+		if err == nil {
+			logrus.Printf("initialized successfully.")
+			return
+		}
+
+		logrus.Warningf("failed to init github data, retry in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > initRetryMax {
+			delay = initRetryMax
+		}
+	}
+}
+
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Time  string `json:"time,omitempty"`
+}
+
+type healthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*healthCheck `json:"checks"`
+}
+
+func (r *healthReport) add(name string, check *healthCheck) {
+	r.Checks[name] = check
+	if !check.OK {
+		r.Status = "unavailable"
+	}
+}
+
+func (r *healthReport) write(rw http.ResponseWriter) {
+	status := http.StatusOK
+	if r.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(rw, status, r)
+}
+
+func newHealthReport() *healthReport {
+	return &healthReport{Status: "ok", Checks: make(map[string]*healthCheck)}
+}
+
+func checkDB() *healthCheck {
+	err := db.Ping()
+	if err != nil {
+		return &healthCheck{Error: err.Error()}
+	}
+	return &healthCheck{OK: true}
+}
+
+func checkLoaded(loaded time.Time, lastErr error) *healthCheck {
+	if loaded.IsZero() {
+		check := &healthCheck{Error: "not loaded yet"}
+		if lastErr != nil {
+			check.Error = fmt.Sprintf("not loaded yet: %v", lastErr)
+		}
+		return check
+	}
+	return &healthCheck{OK: true, Time: loaded.Format(time.RFC3339)}
+}
+
+// checkGithubToken checks the installation token, which is refreshed when
+// it's expired.
+func checkGithubToken() *healthCheck {
+	if githubTransport == nil {
+		return &healthCheck{Error: "github client is not initialized"}
+	}
+	_, err := githubTransport.Token()
+	if err != nil {
+		return &healthCheck{Error: err.Error()}
+	}
+	return &healthCheck{OK: true}
+}
+
+// serveHealthz reports whether the process is alive, which only depends on
+// the database.
+func serveHealthz(rw http.ResponseWriter, r *http.Request) {
+	report := newHealthReport()
+	report.add("database", checkDB())
+	report.write(rw)
+}
+
+// serveReadyz reports whether the bot is ready to handle the webhooks: the
+// database is reachable, the metadata are loaded and the Github token is
+// valid. The time of the kanban metadata is the last successful
+// reconciliation.
+func serveReadyz(rw http.ResponseWriter, r *http.Request) {
+	health.mu.Lock()
+	kanbanLoaded, teamsLoaded, lastErr := health.kanbanLoaded, health.teamsLoaded, health.lastInitError
+	health.mu.Unlock()
+
+	report := newHealthReport()
+	report.add("database", checkDB())
+	report.add("kanban_metadata", checkLoaded(kanbanLoaded, lastErr))
+	report.add("teams_metadata", checkLoaded(teamsLoaded, lastErr))
+	report.add("github_token", checkGithubToken())
+	report.write(rw)
+}
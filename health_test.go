@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getHealthReport(t *testing.T, handler http.HandlerFunc, path string) (int, *healthReport) {
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", path, nil))
+	report := &healthReport{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), report))
+	return rw.Code, report
+}
+
+func TestHealthz(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+
+	code, report := getHealthReport(t, serveHealthz, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", report.Status)
+	assert.True(t, report.Checks["database"].OK)
+
+	db.Close()
+	code, report = getHealthReport(t, serveHealthz, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", report.Status)
+	assert.False(t, report.Checks["database"].OK)
+	assert.NotEmpty(t, report.Checks["database"].Error)
+}
+
+func TestReadyz(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	health.mu.Lock()
+	saved := health.kanbanLoaded
+	savedTeams := health.teamsLoaded
+	savedErr := health.lastInitError
+	health.kanbanLoaded, health.teamsLoaded = time.Time{}, time.Time{}
+	health.lastInitError = errors.New("github is unreachable")
+	health.mu.Unlock()
+	defer func() {
+		health.mu.Lock()
+		health.kanbanLoaded, health.teamsLoaded, health.lastInitError = saved, savedTeams, savedErr
+		health.mu.Unlock()
+	}()
+
+	assert.False(t, isMetadataLoaded())
+	code, report := getHealthReport(t, serveReadyz, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, report.Checks["database"].OK)
+	assert.Equal(t, "not loaded yet: github is unreachable", report.Checks["kanban_metadata"].Error)
+	assert.Equal(t, "not loaded yet: github is unreachable", report.Checks["teams_metadata"].Error)
+
+	markKanbanLoaded()
+	assert.False(t, isMetadataLoaded())
+	markTeamsLoaded()
+	assert.True(t, isMetadataLoaded())
+
+	code, report = getHealthReport(t, serveReadyz, "/readyz")
+	assert.True(t, report.Checks["kanban_metadata"].OK)
+	assert.NotEmpty(t, report.Checks["kanban_metadata"].Time)
+	assert.True(t, report.Checks["teams_metadata"].OK)
+	if githubTransport == nil {
+		// not ready without the github client.
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, "github client is not initialized", report.Checks["github_token"].Error)
+	}
+}
+
+func TestCheckLoaded(t *testing.T) {
+	check := checkLoaded(time.Time{}, nil)
+	assert.False(t, check.OK)
+	assert.Equal(t, "not loaded yet", check.Error)
+
+	loaded := time.Date(2018, 12, 3, 10, 0, 0, 0, time.UTC)
+	check = checkLoaded(loaded, errors.New("the last reload failed"))
+	assert.True(t, check.OK)
+	assert.Equal(t, "2018-12-03T10:00:00Z", check.Time)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	layoutICSDate     = "20060102"
+	layoutICSDateTime = "20060102T150405Z"
+)
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+// writeICSLine writes the content line folded at 75 octets as RFC 5545
+// requires, without breaking the utf-8 characters.
+func writeICSLine(w *bufio.Writer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n ")
+		line = line[cut:]
+		// the leading space of the continuation line counts.
+		limit = 74
+	}
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+// writeCalendar writes the deadlines of the issues as all-day events.
+func writeCalendar(out io.Writer, issues []*trackedIssue, now time.Time) error {
+	w := bufio.NewWriter(out)
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//linuxdeepin//kanbanmgr//CN")
+	writeICSLine(w, "CALSCALE:GREGORIAN")
+	writeICSLine(w, "X-WR-CALNAME:"+icsEscaper.Replace(config().Board.Project))
+
+	for _, issue := range issues {
+		if !issue.hasDeadline() {
+			continue
+		}
+		date := issue.Deadline
+
+		writeICSLine(w, "BEGIN:VEVENT")
+		writeICSLine(w, "UID:"+icsEscaper.Replace(issue.URL))
+		writeICSLine(w, "DTSTAMP:"+now.UTC().Format(layoutICSDateTime))
+		writeICSLine(w, "DTSTART;VALUE=DATE:"+date.Format(layoutICSDate))
+		writeICSLine(w, "DTEND;VALUE=DATE:"+date.AddDate(0, 0, 1).Format(layoutICSDate))
+		writeICSLine(w, "SUMMARY:"+icsEscaper.Replace(fmt.Sprintf("%s %s", issue.Ref, issue.Title)))
+		description := fmt.Sprintf("%s\n列：%s\n指派：%s", issue.HTMLURL, issue.Column,
+			strings.Join(issue.Assignees, ", "))
+		writeICSLine(w, "DESCRIPTION:"+icsEscaper.Replace(description))
+		if issue.HTMLURL != "" {
+			writeICSLine(w, "URL:"+issue.HTMLURL)
+		}
+		writeICSLine(w, "END:VEVENT")
+	}
+
+	writeICSLine(w, "END:VCALENDAR")
+	return w.Flush()
+}
+
+// serveCalendar serves the iCalendar feed of the deadlines, which can be
+// filtered by the assignee, repo and column query parameters.
+func serveCalendar(rw http.ResponseWriter, r *http.Request) {
+	issues, err := getTrackedIssues()
+	if err != nil {
+		logrus.Warning("failed to get tracked issues: ", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	issues = parseIssueFilter(r.URL.Query()).filter(issues)
+
+	rw.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	rw.Header().Set("Content-Disposition", `inline; filename="kanbanmgr.ics"`)
+	err = writeCalendar(rw, issues, time.Now())
+	if err != nil {
+		logrus.Warning("failed to write calendar: ", err)
+	}
+}
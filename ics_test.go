@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCalendar(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	now := time.Date(2018, 12, 4, 9, 0, 0, 0, loc)
+
+	issues := []*trackedIssue{
+		{
+			URL:       "https://api.github.com/repos/linuxdeepin/dde/issues/1",
+			HTMLURL:   "https://github.com/linuxdeepin/dde/issues/1",
+			Ref:       "linuxdeepin/dde#1",
+			Title:     "修复任务栏在多屏下的显示问题, 并且支持分号; 和长标题的折叠显示，长标题需要折叠成多行才能符合规范的要求",
+			Column:    "开发",
+			Assignees: []string{"alice"},
+			Deadline:  time.Date(2018, 12, 6, 0, 0, 0, 0, loc),
+		},
+		{Ref: "linuxdeepin/dde#2"},
+	}
+
+	var buf bytes.Buffer
+	err = writeCalendar(&buf, issues, now)
+	assert.Nil(t, err)
+	ics := buf.String()
+
+	assert.Equal(t, 1, strings.Count(ics, "BEGIN:VEVENT"))
+	assert.Contains(t, ics, "DTSTART;VALUE=DATE:20181206\r\n")
+	assert.Contains(t, ics, "DTEND;VALUE=DATE:20181207\r\n")
+	assert.Contains(t, ics, "DTSTAMP:20181204T010000Z\r\n")
+	for _, line := range strings.Split(ics, "\r\n") {
+		assert.True(t, len(line) <= 75, line)
+	}
+	unfolded := strings.Replace(ics, "\r\n ", "", -1)
+	assert.Contains(t, unfolded, `显示问题\, 并且支持分号\; 和`)
+}
+
+func TestIssueFilter(t *testing.T) {
+	issue := &trackedIssue{Repo: "linuxdeepin/dde", Column: "开发", Assignees: []string{"alice", "bob"}}
+
+	match := func(query string) bool {
+		values, err := url.ParseQuery(query)
+		assert.Nil(t, err)
+		return parseIssueFilter(values).match(issue)
+	}
+	assert.True(t, match(""))
+	assert.True(t, match("assignee=bob"))
+	assert.True(t, match("assignee=carol,alice&repo=linuxdeepin/dde"))
+	assert.False(t, match("assignee=carol"))
+	assert.False(t, match("assignee=bob&column=测试"))
+	assert.True(t, match("column=测试&column=开发"))
+}
+
+func TestCalendarAuth(t *testing.T) {
+	old := config()
+	defer setConfig(old)
+
+	handler := feedHandler(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("BEGIN:VCALENDAR\r\n"))
+	})
+	get := func(target, auth string) int {
+		r := httptest.NewRequest("GET", target, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, r)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("/calendar.ics?token=0123456789abcdef", ""))
+
+	c := defaultConfig()
+	c.API.Tokens = []string{"0123456789abcdef"}
+	setConfig(c)
+	assert.Equal(t, http.StatusUnauthorized, get("/calendar.ics", ""))
+	assert.Equal(t, http.StatusUnauthorized, get("/calendar.ics?token=0123456789abcdeg", ""))
+	assert.Equal(t, http.StatusOK, get("/calendar.ics?token=0123456789abcdef&assignee=alice", ""))
+	assert.Equal(t, http.StatusOK, get("/calendar.ics", "Bearer 0123456789abcdef"))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// issueCacheTTL is how long a cached issue is used. The issues changed
+// without an event, e.g. while the bot was down, are fetched again after it,
+// and the issues not seen for it are dropped, so the cache doesn't grow
+// with every issue ever seen.
+const issueCacheTTL = time.Hour
+
+// issueCache keeps the latest known state of the issues by their api url,
+// it's updated by the issues events and every time an issue is fetched.
+var (
+	issueCache         = make(map[string]*cachedIssue)
+	issueCachePrunedAt time.Time
+	issueCacheLock     sync.Mutex
+)
+
+type cachedIssue struct {
+	issue    *github.Issue
+	cachedAt time.Time
+}
+
+func cacheIssue(issue *github.Issue) {
+	issueCacheLock.Lock()
+	defer issueCacheLock.Unlock()
+
+	now := time.Now()
+	issueCache[issue.GetURL()] = &cachedIssue{issue, now}
+	if now.Sub(issueCachePrunedAt) > issueCacheTTL {
+		pruneIssueCacheLocked(now)
+		issueCachePrunedAt = now
+	}
+}
+
+func getCachedIssue(issueURL string) *github.Issue {
+	issueCacheLock.Lock()
+	defer issueCacheLock.Unlock()
+
+	cached := issueCache[issueURL]
+	if cached == nil || time.Since(cached.cachedAt) > issueCacheTTL {
+		return nil
+	}
+	return cached.issue
+}
+
+// evictIssue drops the issue from the cache, e.g. when it's deleted or
+// transferred, so its url is no longer valid.
+func evictIssue(issueURL string) {
+	issueCacheLock.Lock()
+	defer issueCacheLock.Unlock()
+
+	delete(issueCache, issueURL)
+}
+
+func pruneIssueCacheLocked(now time.Time) {
+	for issueURL, cached := range issueCache {
+		if now.Sub(cached.cachedAt) > issueCacheTTL {
+			delete(issueCache, issueURL)
+		}
+	}
+}
+
+// getIssueByURL returns the cached issue, or fetches it if not cached.
+func getIssueByURL(issueURL string) (*github.Issue, error) {
+	issue := getCachedIssue(issueURL)
+	if issue != nil {
+		return issue, nil
+	}
+	return fetchIssue(issueURL)
+}
+
+// fetchIssue fetches the issue from Github and updates the cache.
+func fetchIssue(issueURL string) (*github.Issue, error) {
+	owner, repo, num, err := parseIssueURL(issueURL)
+	if err != nil {
+		return nil, err
+	}
+	issue, _, err := client.Issues.Get(context.Background(), owner, repo, num)
+	if err != nil {
+		return nil, err
+	}
+	cacheIssue(issue)
+	return issue, nil
+}
+
+func getIssueAssignees(issue *github.Issue) []string {
+	var ret []string
+	for _, assignee := range issue.Assignees {
+		ret = append(ret, assignee.GetLogin())
+	}
+	return ret
+}
+
+// trackedIssue is an issue on the board with its deadline.
+type trackedIssue struct {
+	URL           string    `json:"url"`
+	HTMLURL       string    `json:"html_url"`
+	Ref           string    `json:"ref"`
+	Repo          string    `json:"repo"`
+	Title         string    `json:"title"`
+	State         string    `json:"state"`
+	Assignees     []string  `json:"assignees"`
+	CardID        int64     `json:"card_id"`
+	Column        string    `json:"column"`
+	InColumnSince time.Time `json:"in_column_since"`
+	// Deadline is the day of the deadline, see IssueDeadline.date, it's
+	// in the json as DeadlineDate so it isn't shifted by the timezone.
+	Deadline     time.Time `json:"-"`
+	DeadlineDate string    `json:"deadline,omitempty"`
+	Directive    string    `json:"directive,omitempty"`
+	// Location is the timezone of the issue, the day of the deadline ends
+	// in it. Nil means the board timezone.
+	Location *time.Location `json:"-"`
+}
+
+func (i *trackedIssue) hasDeadline() bool {
+	return !i.Deadline.IsZero()
+}
+
+// isOverdueAt checks whether the issue is open and the day of its deadline
+// is over at now in the timezone of the issue.
+func (i *trackedIssue) isOverdueAt(now time.Time) bool {
+	if i.State != "open" || !i.hasDeadline() {
+		return false
+	}
+	loc := i.Location
+	if loc == nil {
+		loc = config().boardLocation()
+	}
+	return isDeadlinePassedAt(now.In(loc), i.Deadline)
+}
+
+// getTrackedIssues returns the issues of the cards in the target columns,
+// the issues failed to fetch are skipped.
+func getTrackedIssues() ([]*trackedIssue, error) {
+	var ret []*trackedIssue
+	for _, bc := range getBoardCards() {
+		contentURL := bc.card.GetContentURL()
+		if contentURL == "" {
+			continue
+		}
+		owner, repo, num, err := parseIssueURL(contentURL)
+		if err != nil {
+			continue
+		}
+		issue, err := getIssueByURL(contentURL)
+		if err != nil {
+			logrus.Warningf("failed to get issue %s: %v", contentURL, err)
+			continue
+		}
+		issueDeadline, err := getIssueDeadlineByURL(contentURL)
+		if err != nil {
+			return nil, err
+		}
+
+		tracked := &trackedIssue{
+			URL:           contentURL,
+			HTMLURL:       issue.GetHTMLURL(),
+			Ref:           issueRef(owner, repo, num),
+			Repo:          owner + "/" + repo,
+			Title:         issue.GetTitle(),
+			State:         issue.GetState(),
+			Assignees:     getIssueAssignees(issue),
+			CardID:        bc.card.GetID(),
+			Column:        bc.column,
+			InColumnSince: cardColumnSince(bc.card, bc.column),
+			Location:      config().issueLocation(issue),
+		}
+		if issueDeadline != nil {
+			tracked.Deadline = issueDeadline.date
+			tracked.DeadlineDate = formatDate(issueDeadline.date)
+			tracked.Directive = issueDeadline.directive
+		}
+		ret = append(ret, tracked)
+	}
+	return ret, nil
+}
+
+// issueFilter filters the tracked issues by the query parameters, an issue
+// matches if it matches any of the values of every given parameter.
+type issueFilter struct {
+	assignees []string
+	repos     []string
+	columns   []string
+}
+
+func parseIssueFilter(query url.Values) *issueFilter {
+	return &issueFilter{
+		assignees: splitValues(query["assignee"]),
+		repos:     splitValues(query["repo"]),
+		columns:   splitValues(query["column"]),
+	}
+}
+
+// splitValues splits the comma separated values, so both ?repo=a&repo=b and
+// ?repo=a,b are supported.
+func splitValues(values []string) []string {
+	var ret []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+func matchAny(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *issueFilter) match(issue *trackedIssue) bool {
+	if len(f.assignees) > 0 {
+		matched := false
+		for _, assignee := range issue.Assignees {
+			if matchAny(f.assignees, assignee) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.repos) > 0 && !matchAny(f.repos, issue.Repo) {
+		return false
+	}
+	if len(f.columns) > 0 && !matchAny(f.columns, issue.Column) {
+		return false
+	}
+	return true
+}
+
+func (f *issueFilter) filter(issues []*trackedIssue) []*trackedIssue {
+	var ret []*trackedIssue
+	for _, issue := range issues {
+		if f.match(issue) {
+			ret = append(ret, issue)
+		}
+	}
+	return ret
+}
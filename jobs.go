@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// job is a background job run by the scheduler.
+type job struct {
+	name string
+	run  func() error
+	// spec returns the cron expression of the job, empty means disabled.
+	spec func(c *Config) string
+	// runOnStart makes the job run once when the scheduler starts.
+	runOnStart bool
+	// lowPriority jobs wait when the github rate limit is low.
+	lowPriority bool
+	// everyReplica jobs only refresh the local state, so they run on every
+	// replica, the others only run on the leader.
+	everyReplica bool
+}
+
+var jobs = []*job{
+	// the backfill runs before the delay check, so the delay check sees the
+	// deadlines set while the bot was down.
+	{
+		name: "deadline-backfill",
+		run: func() error {
+			return backfillDeadlines(logrus.WithField("job", "deadline-backfill"), config().Deadlines.BackfillConcurrency)
+		},
+		spec:        func(c *Config) string { return c.Jobs.DeadlineBackfill },
+		runOnStart:  true,
+		lowPriority: true,
+	},
+	{
+		name: "delay-check",
+		run: func() error {
+			checkIssueDeadlineForAllCards(logrus.WithField("job", "delay-check"))
+			return nil
+		},
+		spec:       (*Config).delayCheckSpec,
+		runOnStart: true,
+	},
+	{
+		name: "reminders",
+		run:  remindDeadlines,
+		spec: func(c *Config) string { return c.Jobs.Reminders },
+	},
+	{
+		name:         "reconcile",
+		run:          PrepareKanbanMetadata,
+		spec:         func(c *Config) string { return c.Jobs.Reconcile },
+		lowPriority:  true,
+		everyReplica: true,
+	},
+	{
+		name:         "team-refresh",
+		run:          UpdateTeamsMetadata,
+		spec:         func(c *Config) string { return c.Jobs.TeamRefresh },
+		lowPriority:  true,
+		everyReplica: true,
+	},
+	{
+		name: "prune-deliveries",
+		run: func() error {
+			err := pruneDeliveries(time.Now().Add(-deliveryRetention))
+			if err != nil {
+				return err
+			}
+			return pruneQueuedWebhooks(time.Now().Add(-webhookQueueRetention))
+		},
+		spec: func(c *Config) string { return c.Jobs.PruneDeliveries },
+	},
+	{
+		name: "daily-report",
+		run: func() error {
+			return publishDigest(digestDaily)
+		},
+		spec:        func(c *Config) string { return c.Jobs.DailyReport },
+		lowPriority: true,
+	},
+	{
+		name: "weekly-report",
+		run: func() error {
+			return publishDigest(digestWeekly)
+		},
+		spec:        func(c *Config) string { return c.Jobs.WeeklyReport },
+		lowPriority: true,
+	},
+	{
+		name:        "flow-snapshot",
+		run:         takeFlowSnapshot,
+		spec:        func(c *Config) string { return c.Jobs.FlowSnapshot },
+		lowPriority: true,
+	},
+}
+
+// delayCheckSpec falls back to check daily at board.check_time.
+func (c *Config) delayCheckSpec() string {
+	if c.Jobs.DelayCheck != "" {
+		return c.Jobs.DelayCheck
+	}
+	clock, err := time.Parse(layoutClock, c.Board.CheckTime)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d * * *", clock.Minute(), clock.Hour())
+}
+
+// parseJobSpec parses the cron expression, which is in the board timezone
+// unless a CRON_TZ is given.
+func parseJobSpec(spec string, c *Config) (cron.Schedule, error) {
+	if !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		spec = fmt.Sprintf("CRON_TZ=%s %s", c.Board.Timezone, spec)
+	}
+	return cron.ParseStandard(spec)
+}
+
+func (c *Config) validateJobs() []string {
+	var problems []string
+	for _, j := range jobs {
+		spec := j.spec(c)
+		if spec == "" {
+			continue
+		}
+		_, err := parseJobSpec(spec, c)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("schedule of job %s: %v", j.name, err))
+		}
+	}
+	return problems
+}
+
+// jobScheduler runs the jobs on their schedules, and records every run in
+// the job_run table, so the missed runs can be caught up after downtime.
+type jobScheduler struct {
+	mu      sync.Mutex
+	cron    *cron.Cron
+	running map[string]bool
+	started bool
+	stopped bool
+	// wg tracks the running jobs, including the ones caught up.
+	wg sync.WaitGroup
+	// ranOnStart are the runOnStart jobs run by this process, which aren't
+	// run again when it becomes the leader again.
+	ranOnStart map[string]bool
+	// ctx is canceled by Stop, which stops the jobs waiting for the rate
+	// limit.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobScheduler() *jobScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobScheduler{
+		cron:       cron.New(),
+		running:    make(map[string]bool),
+		ranOnStart: make(map[string]bool),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Start schedules the jobs and runs the jobs which have missed their runs.
+// It does nothing once the scheduler is stopped.
+func (s *jobScheduler) Start(c *Config) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	s.Reschedule(c)
+	s.cron.Start()
+	go s.catchUp(c, time.Now())
+}
+
+// CatchUp runs the jobs which have missed their runs, e.g. while another
+// replica was the leader. It does nothing before Start.
+func (s *jobScheduler) CatchUp() {
+	s.mu.Lock()
+	started := s.started && !s.stopped
+	s.mu.Unlock()
+	if started {
+		go s.catchUp(config(), time.Now())
+	}
+}
+
+// Reschedule replaces the schedules with the ones in c.
+func (s *jobScheduler) Reschedule(c *Config) {
+	for _, entry := range s.cron.Entries() {
+		s.cron.Remove(entry.ID)
+	}
+
+	for _, j := range jobs {
+		spec := j.spec(c)
+		if spec == "" {
+			continue
+		}
+		schedule, err := parseJobSpec(spec, c)
+		if err != nil {
+			logrus.Warningf("invalid schedule %q of job %s: %v", spec, j.name, err)
+			continue
+		}
+		j := j
+		s.cron.Schedule(schedule, cron.FuncJob(func() {
+			s.runJob(j)
+		}))
+	}
+}
+
+// Stop stops scheduling the jobs, and waits for the running ones until ctx
+// is done.
+func (s *jobScheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.cancel()
+
+	<-s.cron.Stop().Done()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *jobScheduler) catchUp(c *Config, now time.Time) {
+	for _, j := range jobs {
+		spec := j.spec(c)
+		if spec == "" || (!j.everyReplica && !isLeader()) {
+			continue
+		}
+		schedule, err := parseJobSpec(spec, c)
+		if err != nil {
+			continue
+		}
+		lastRun, err := getJobLastRun(j.name)
+		if err != nil {
+			logrus.Warningf("failed to get the last run of job %s: %v", j.name, err)
+			continue
+		}
+
+		missed := !lastRun.IsZero() && schedule.Next(lastRun).Before(now)
+		onStart := false
+		if j.runOnStart {
+			s.mu.Lock()
+			onStart = !s.ranOnStart[j.name]
+			s.ranOnStart[j.name] = true
+			s.mu.Unlock()
+		}
+		if onStart || missed {
+			if missed {
+				logrus.Infof("job %s missed the run after %v, catch up", j.name, lastRun)
+			}
+			s.runJob(j)
+		}
+	}
+}
+
+// runJob runs the job unless it's still running, or it's for the leader
+// only and this replica isn't the leader.
+func (s *jobScheduler) runJob(j *job) {
+	log := logrus.WithField("job", j.name)
+	if !j.everyReplica && !isLeader() {
+		log.Debug("not the leader, skip this run")
+		return
+	}
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	if s.running[j.name] {
+		s.mu.Unlock()
+		log.Warning("job is still running, skip this run")
+		return
+	}
+	s.running[j.name] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, j.name)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	if j.lowPriority {
+		err := githubRateLimit.waitForBudget(s.ctx, "job "+j.name)
+		if err != nil {
+			log.Info("stopped waiting for the rate limit, skip this run")
+			return
+		}
+	}
+
+	log.Info("run job")
+	start := time.Now()
+	err := j.run()
+	duration := time.Since(start)
+	result := "success"
+	if err != nil {
+		result = "failure"
+		log.Warningf("job failed after %v: %v", duration, err)
+	}
+	jobDuration.WithLabelValues(j.name, result).Observe(duration.Seconds())
+
+	err = recordJobRun(j.name, start, duration, err)
+	if err != nil {
+		log.Warning("failed to record the run of job: ", err)
+	}
+}
+
+func recordJobRun(name string, start time.Time, duration time.Duration, runErr error) error {
+	var errMsg string
+	if runErr != nil {
+		errMsg = runErr.Error()
+	}
+	_, err := db.Exec(`INSERT INTO job_run (name,last_run,duration_ms,error) VALUES (?,?,?,?)
+		ON CONFLICT (name) DO UPDATE SET last_run = excluded.last_run, duration_ms = excluded.duration_ms, error = excluded.error`,
+		name, start, int64(duration/time.Millisecond), errMsg)
+	return err
+}
+
+func getJobLastRun(name string) (time.Time, error) {
+	var lastRun time.Time
+	err := db.QueryRow(`SELECT last_run FROM job_run WHERE name = ?`, name).Scan(&lastRun)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return lastRun, err
+}
+
+type jobStatus struct {
+	Name     string    `json:"name"`
+	Spec     string    `json:"spec"`
+	LastRun  time.Time `json:"last_run"`
+	Duration int64     `json:"duration_ms"`
+	Error    string    `json:"error"`
+	NextRun  time.Time `json:"next_run"`
+}
+
+func listJobStatus(c *Config, now time.Time) ([]*jobStatus, error) {
+	var ret []*jobStatus
+	for _, j := range jobs {
+		status := &jobStatus{
+			Name: j.name,
+			Spec: j.spec(c),
+		}
+		err := db.QueryRow(`SELECT last_run,duration_ms,error FROM job_run WHERE name = ?`, j.name).
+			Scan(&status.LastRun, &status.Duration, &status.Error)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if status.Spec != "" {
+			schedule, err := parseJobSpec(status.Spec, c)
+			if err == nil {
+				status.NextRun = schedule.Next(now)
+			}
+		}
+		ret = append(ret, status)
+	}
+	return ret, nil
+}
+
+func formatStatusTime(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.In(loc).Format("2006-01-02 15:04:05")
+}
+
+// runJobs implements the jobs subcommand, which prints the status of the jobs.
+func runJobs(args []string) error {
+	flags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	registerConfigFlag(flags)
+	flags.Parse(args)
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = joinProblems(c.validateBoard())
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	err = initDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+
+	statuses, err := listJobStatus(c, time.Now())
+	if err != nil {
+		return err
+	}
+
+	loc := c.boardLocation()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tSCHEDULE\tLAST RUN\tDURATION\tNEXT RUN\tERROR")
+	for _, status := range statuses {
+		spec := status.Spec
+		if spec == "" {
+			spec = "disabled"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\n", status.Name, spec,
+			formatStatusTime(status.LastRun, loc), time.Duration(status.Duration)*time.Millisecond,
+			formatStatusTime(status.NextRun, loc), status.Error)
+	}
+	return w.Flush()
+}
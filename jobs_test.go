@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobSpec(t *testing.T) {
+	c := defaultConfig()
+	assert.Equal(t, "0 1 * * *", c.delayCheckSpec())
+
+	c.Board.CheckTime = "23:30"
+	assert.Equal(t, "30 23 * * *", c.delayCheckSpec())
+
+	c.Jobs.DelayCheck = "0 9 * * 1-5"
+	assert.Equal(t, "0 9 * * 1-5", c.delayCheckSpec())
+
+	// the schedule is in the board timezone.
+	schedule, err := parseJobSpec("0 1 * * *", c)
+	assert.Nil(t, err)
+	now, err := time.Parse(time.RFC3339, "2018-12-03T12:00:00Z")
+	assert.Nil(t, err)
+	assert.Equal(t, "2018-12-03T17:00:00Z", schedule.Next(now).UTC().Format(time.RFC3339))
+
+	c.Jobs.Reconcile = "0 25 * * *"
+	assert.Len(t, c.validateJobs(), 1)
+}
+
+func TestStopJobWaitingForBudget(t *testing.T) {
+	old := githubRateLimit
+	defer func() { githubRateLimit = old }()
+	githubRateLimit = newRateLimitTransport(nil, time.Second, 100)
+	githubRateLimit.remaining = 10
+	githubRateLimit.reset = time.Now().Add(time.Hour)
+
+	ran := false
+	j := &job{
+		name:         "low-priority",
+		run:          func() error { ran = true; return nil },
+		lowPriority:  true,
+		everyReplica: true,
+	}
+	s := newJobScheduler()
+	done := make(chan struct{})
+	go func() {
+		s.runJob(j)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.running[j.name]
+	}, time.Second, 10*time.Millisecond)
+
+	// Stop doesn't wait for the reset of the rate limit.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, s.Stop(ctx))
+	<-done
+	assert.False(t, ran)
+}
+
+func TestCatchUpRunsOnStartOnce(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	oldJobs := jobs
+	defer func() { jobs = oldJobs }()
+
+	runs := 0
+	jobs = []*job{{
+		name:         "on-start",
+		run:          func() error { runs++; return nil },
+		spec:         func(c *Config) string { return "0 1 * * *" },
+		runOnStart:   true,
+		everyReplica: true,
+	}}
+	c := defaultConfig()
+	s := newJobScheduler()
+	s.catchUp(c, time.Now())
+	assert.Equal(t, 1, runs)
+	// e.g. this replica becomes the leader again.
+	s.catchUp(c, time.Now())
+	assert.Equal(t, 1, runs)
+
+	// the missed runs are still caught up.
+	s.catchUp(c, time.Now().Add(48*time.Hour))
+	assert.Equal(t, 2, runs)
+}
+
+func TestRemindDeadlines(t *testing.T) {
+	const (
+		repoURL   = "https://api.github.com/repos/linuxdeepin/dde"
+		urlDue    = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+		urlClosed = "https://api.github.com/repos/linuxdeepin/dde/issues/2"
+		urlLater  = "https://api.github.com/repos/linuxdeepin/dde/issues/3"
+	)
+	var out bytes.Buffer
+	board := &fakeBoard{
+		out:      &out,
+		Projects: []*fakeProject{{ID: 1, Name: config().Board.Project}},
+		Columns:  []*fakeColumn{{ID: 11, ProjectID: 1, Name: config().Board.DevelopingColumn}},
+		Cards: []*fakeCard{
+			{ID: 101, ColumnID: 11, ContentURL: urlDue},
+			{ID: 102, ColumnID: 11, ContentURL: urlClosed},
+			{ID: 103, ColumnID: 11, ContentURL: urlLater},
+		},
+		Issues: []*github.Issue{
+			{ID: github.Int64(1001), Number: github.Int(1), URL: github.String(urlDue), State: github.String("open"),
+				RepositoryURL: github.String(repoURL), Assignees: []*github.User{{Login: github.String("alice")}}},
+			{ID: github.Int64(1002), Number: github.Int(2), URL: github.String(urlClosed), State: github.String("closed"),
+				RepositoryURL: github.String(repoURL)},
+			{ID: github.Int64(1003), Number: github.Int(3), URL: github.String(urlLater), State: github.String("open"),
+				RepositoryURL: github.String(repoURL)},
+		},
+	}
+	var stop func()
+	client, stop = board.newClient()
+	defer stop()
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	assert.Nil(t, PrepareKanbanMetadata())
+	today := time.Now().In(config().boardLocation())
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1001, date: today, url: urlDue, directive: "0"}))
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1002, date: today, url: urlClosed, directive: "0"}))
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1003, date: today.AddDate(0, 0, 1), url: urlLater, directive: "1"}))
+
+	var reminders *job
+	for _, j := range jobs {
+		if j.name == "reminders" {
+			reminders = j
+		}
+	}
+	assert.NotNil(t, reminders)
+	c := defaultConfig()
+	// not run unless scheduled.
+	assert.Equal(t, "", reminders.spec(c))
+	c.Jobs.Reminders = "0 9 * * *"
+	assert.Equal(t, "0 9 * * *", reminders.spec(c))
+	assert.Empty(t, c.validateJobs())
+	c.Jobs.Reminders = "0 25 * * *"
+	assert.Len(t, c.validateJobs(), 1)
+
+	assert.Nil(t, reminders.run())
+	// every issue is reminded once a day.
+	assert.Nil(t, reminders.run())
+	assert.Equal(t, 1, strings.Count(out.String(), "comment on"))
+	assert.Contains(t, out.String(), "comment on linuxdeepin/dde#1: @alice 今天（"+formatDate(today)+"）是截止日期，请及时完成。")
+	reminded, err := listDeadlineReminders(1001)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{formatDate(today)}, reminded)
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/cosiner/gohper/regexp"
+	"regexp"
 	"strconv"
 	"sync"
 
@@ -66,14 +66,14 @@ func getProjectColumns(project *github.Project) ([]*github.ProjectColumn, error)
 	return ret, nil
 }
 
-func getProjects() ([]*github.Project, error) {
+func getProjects(org string) ([]*github.Project, error) {
 	var ret []*github.Project
 
 	ctx := context.Background()
 	opts := &github.ProjectListOptions{}
 
 	for {
-		projs, resp, err := client.Organizations.ListProjects(ctx, OrgName, opts)
+		projs, resp, err := client.Organizations.ListProjects(ctx, org, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -108,98 +108,69 @@ func isCardInTargetColumns(card *github.ProjectCard) bool {
 
 func isTargetColumn(column *github.ProjectColumn) bool {
 	columnName := column.GetName()
-	return columnName == DevelopingColumnName || columnName == TestingColumnName
+	board := config().Board
+	return columnName == board.DevelopingColumn || columnName == board.TestingColumn
 }
 
-func handleCardCreated(card *github.ProjectCard) error {
+// applyCardEvent tracks the card while it's in the target columns. Every
+// replica applies the card events, so its cards are up to date whichever
+// replica is the leader.
+func applyCardEvent(log *logrus.Entry, action string, card *github.ProjectCard) {
 	cardsLock.Lock()
 	defer cardsLock.Unlock()
 
-	in := isCardInTargetColumns(card)
-	if !in {
-		return errNotInTargetCol
-	}
-
-	metaCards = append(metaCards, card)
-
-	go processCardIssueDeadline(card)
-	return nil
-}
-
-func handleCardDeleted(card *github.ProjectCard) error {
-	cardsLock.Lock()
-	defer cardsLock.Unlock()
-
-	in := isCardInTargetColumns(card)
-	if !in {
-		return errNotInTargetCol
-	}
-
+	in := action != "deleted" && isCardInTargetColumns(card)
 	index := findCard(card)
-	if index == -1 {
-		return errNotInTargetCol
-	}
 
-	metaCards[index] = metaCards[len(metaCards)-1]
-	metaCards[len(metaCards)-1] = nil
-	metaCards = metaCards[:len(metaCards)-1]
+	switch {
+	case in && index == -1:
+		metaCards = append(metaCards, card)
+		log.Info("card moved into the target columns, track it")
 
-	go deleteCardIssueDeadline(card)
-	return nil
-}
-
-func handleCardConverted(card *github.ProjectCard) error {
-	cardsLock.Lock()
-	defer cardsLock.Unlock()
+	case in:
+		metaCards[index] = card
 
-	in := isCardInTargetColumns(card)
-	if !in {
-		return errNotInTargetCol
+	case index != -1:
+		metaCards[index] = metaCards[len(metaCards)-1]
+		metaCards[len(metaCards)-1] = nil
+		metaCards = metaCards[:len(metaCards)-1]
+		log.Info("card left the target columns, untrack it")
 	}
+}
 
-	index := findCard(card)
-	if index == -1 {
-		return errNotInTargetCol
+// handleCardEvent syncs the deadline of the issue of the card in the target
+// columns, and deletes it when the card leaves them. The payload doesn't
+// tell the column a card is moved from, so a move between the target
+// columns syncs the deadline again, which is harmless.
+func handleCardEvent(log *logrus.Entry, action string, card *github.ProjectCard) error {
+	if card.GetContentURL() == "" {
+		// a note has no deadline.
+		return nil
 	}
 
-	metaCards[index] = card
-
-	go processCardIssueDeadline(card)
-	return nil
-}
-
-func handleCardMoved(card *github.ProjectCard) error {
 	cardsLock.Lock()
-	defer cardsLock.Unlock()
-
-	in := isCardInTargetColumns(card)
-	index := findCard(card)
-
-	if in {
-		// move into
-		if index == -1 {
-			// append
-			metaCards = append(metaCards, card)
-			logrus.Info("handleCardMoved append")
-			go processCardIssueDeadline(card)
-
-		} else {
-			// update
-			metaCards[index] = card
-			logrus.Info("handleCardMoved update")
+	col, err := getCardColumn(card)
+	cardsLock.Unlock()
+	if err != nil {
+		// the card is on another project.
+		return nil
+	}
+	in := isTargetColumn(col)
+
+	switch action {
+	case "created", "converted", "moved":
+		if in {
+			return issueExecutor.Run(card.GetContentURL(), func() error {
+				return processCardIssueDeadline(log, card)
+			})
+		}
+		if action == "moved" {
+			return deleteCardIssueDeadline(log, card)
 		}
 
-	} else {
-		// move out
-		if index == -1 {
-			logrus.Info("handleCardMoved ignore")
-		} else {
-			// delete
-			metaCards[index] = metaCards[len(metaCards)-1]
-			metaCards[len(metaCards)-1] = nil
-			metaCards = metaCards[:len(metaCards)-1]
-			logrus.Info("handleCardMoved delete")
-			go deleteCardIssueDeadline(card)
+	case "deleted":
+		if in {
+			return deleteCardIssueDeadline(log, card)
 		}
 	}
 	return nil
@@ -218,60 +189,72 @@ func getIssueWithCard(card *github.ProjectCard) (*github.Issue, error) {
 		if err != nil {
 			return nil, err
 		}
+		cacheIssue(issue)
 		return issue, nil
 	}
 	return nil, errors.New("card is not issue")
 }
 
-func processCardIssueDeadline(card *github.ProjectCard) {
+func processCardIssueDeadline(log *logrus.Entry, card *github.ProjectCard) error {
 	issue, err := getIssueWithCard(card)
 	if err != nil {
-		logrus.Warning("failed to get issue with card: ", err)
-		return
+		return fmt.Errorf("failed to get issue with card: %v", err)
 	}
-	processIssueDeadline(issue)
+	return processIssueDeadline(log, issue)
 }
 
-func deleteCardIssueDeadline(card *github.ProjectCard) {
-	issue, err := getIssueWithCard(card)
-	if err != nil {
-		logrus.Warning("failed to get issue with card: ", err)
-		return
-	}
-	id := issue.GetID()
-	logrus.Infof("delete issue %d deadline", id)
-	err = deleteIssueDeadline(id)
-	if err != nil {
-		logrus.Warning("failed to delete issue deadline: ", err)
-		return
-	}
+func deleteCardIssueDeadline(log *logrus.Entry, card *github.ProjectCard) error {
+	return issueExecutor.Run(card.GetContentURL(), func() error {
+		log.Infof("delete the deadline of %s", card.GetContentURL())
+		err := deleteIssueDeadlineByURL(card.GetContentURL())
+		if err != nil {
+			return fmt.Errorf("failed to delete issue deadline: %v", err)
+		}
+		return nil
+	})
 }
 
+// PrepareKanbanMetadata updates the metaCards and metaColumns of the board.
 func PrepareKanbanMetadata() error {
+	cards, columns, err := fetchKanbanMetadata(config())
+	if err != nil {
+		return err
+	}
+
 	cardsLock.Lock()
-	defer cardsLock.Unlock()
+	metaCards = cards
+	metaColumns = columns
+	cardsLock.Unlock()
+
+	markKanbanLoaded()
+	return nil
+}
 
+// fetchKanbanMetadata fetches the cards in the target columns and all the
+// columns of the board configured in c.
+func fetchKanbanMetadata(c *Config) (metaCards []*github.ProjectCard, metaColumns []*github.ProjectColumn, err error) {
 	metaCards = []*github.ProjectCard{}
 	metaColumns = []*github.ProjectColumn{}
 
-	projects, err := getProjects()
+	board := c.Board
+	projects, err := getProjects(c.Org)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	for _, pro := range projects {
-		if pro.GetName() == TargetProject {
+		if pro.GetName() == board.Project {
 			columns, err := getProjectColumns(pro)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 			for _, col := range columns {
-				if col.GetName() != TestingColumnName && col.GetName() != DevelopingColumnName {
+				if col.GetName() != board.TestingColumn && col.GetName() != board.DevelopingColumn {
 					continue
 				}
 
 				cards, err := getColumnCards(col)
 				if err != nil {
-					return err
+					return nil, nil, err
 				}
 
 				for _, card := range cards {
@@ -280,16 +263,20 @@ func PrepareKanbanMetadata() error {
 					metaCards = append(metaCards, card)
 				}
 
-				logrus.Infof("got %v cards in column \"%v\"", len(cards), col.GetName())
+				logrus.WithField("column", col.GetName()).Infof("got %v cards", len(cards))
 			}
 			metaColumns = append(metaColumns, columns...)
 		}
 	}
 
-	return nil
+	return metaCards, metaColumns, nil
 }
 
-func moveCard(card *github.ProjectCard, column *github.ProjectColumn) error {
+func moveCard(log *logrus.Entry, card *github.ProjectCard, column *github.ProjectColumn) error {
+	if config().DryRun {
+		return recordAction(log, actionMoveCard, fmt.Sprintf("card %d", card.GetID()), column.GetName())
+	}
+
 	ctx := context.Background()
 	opts := &github.ProjectCardMoveOptions{
 		Position: "top",
@@ -303,10 +290,10 @@ func moveCard(card *github.ProjectCard, column *github.ProjectColumn) error {
 	return nil
 }
 
-func moveIssue(issue *github.Issue, column *github.ProjectColumn) error {
+func moveIssue(log *logrus.Entry, issue *github.Issue, column *github.ProjectColumn) error {
 	for _, card := range metaCards {
 		if card.GetContentURL() == issue.GetURL() && card.GetColumnID() != column.GetID() {
-			err := moveCard(card, column)
+			err := moveCard(log, card, column)
 			if err == nil {
 				columnID := column.GetID()
 				card.ColumnID = &columnID
@@ -317,27 +304,65 @@ func moveIssue(issue *github.Issue, column *github.ProjectColumn) error {
 	return errNotInTargetCol
 }
 
-func moveIssueToColumn(issue *github.Issue, columnName string) error {
+func moveIssueToColumn(log *logrus.Entry, issue *github.Issue, columnName string) error {
 	for _, col := range metaColumns {
 		if col.GetName() == columnName {
-			return moveIssue(issue, col)
+			return moveIssue(log, issue, col)
 		}
 	}
-	return fmt.Errorf("no column named %v in project %v", columnName, TargetProject)
+	return fmt.Errorf("no column named %v in project %v", columnName, config().Board.Project)
 }
 
-func MoveToTesting(issue *github.Issue) error {
+func MoveToTesting(log *logrus.Entry, issue *github.Issue) error {
 	cardsLock.Lock()
 	defer cardsLock.Unlock()
 
-	return moveIssueToColumn(issue, TestingColumnName)
+	return moveIssueToColumn(log, issue, config().Board.TestingColumn)
 }
 
-func MoveToDeveloping(issue *github.Issue) error {
+func MoveToDeveloping(log *logrus.Entry, issue *github.Issue) error {
 	cardsLock.Lock()
 	defer cardsLock.Unlock()
 
-	return moveIssueToColumn(issue, DevelopingColumnName)
+	return moveIssueToColumn(log, issue, config().Board.DevelopingColumn)
+}
+
+// boardCard is a snapshot of a card in the target columns.
+type boardCard struct {
+	card   *github.ProjectCard
+	column string
+}
+
+func getBoardCards() []*boardCard {
+	cardsLock.Lock()
+	defer cardsLock.Unlock()
+
+	var ret []*boardCard
+	for _, card := range metaCards {
+		var columnName string
+		col, err := getCardColumn(card)
+		if err == nil {
+			columnName = col.GetName()
+		}
+		ret = append(ret, &boardCard{card, columnName})
+	}
+	return ret
+}
+
+// getCardContentURLs returns the content urls of the cards in the target
+// columns, the notes are skipped.
+func getCardContentURLs() []string {
+	cardsLock.Lock()
+	defer cardsLock.Unlock()
+
+	var ret []string
+	for _, card := range metaCards {
+		contentURL := card.GetContentURL()
+		if contentURL != "" {
+			ret = append(ret, contentURL)
+		}
+	}
+	return ret
 }
 
 func getCardColumn(card *github.ProjectCard) (*github.ProjectColumn, error) {
@@ -389,6 +414,21 @@ func parseIssueURL(contentURL string) (owner, repo string, number int, err error
 	return
 }
 
+var regIssueRef = regexp.MustCompile(`^([^/\s]+)/([^/\s#]+)#(\d+)$`)
+
+// parseIssueRef parses the issue reference in the form of owner/repo#num.
+func parseIssueRef(ref string) (owner, repo string, number int, err error) {
+	match := regIssueRef.FindStringSubmatch(ref)
+	if match == nil {
+		err = fmt.Errorf("invalid issue reference %q, expect owner/repo#num", ref)
+		return
+	}
+	owner = match[1]
+	repo = match[2]
+	number, err = strconv.Atoi(match[3])
+	return
+}
+
 var regRepoURL = regexp.MustCompile(`/repos/([^/]+)/([^/]+)$`)
 
 func parseRepoURL(repoURL string) (owner, repo string, err error) {
@@ -402,36 +442,30 @@ func parseRepoURL(repoURL string) (owner, repo string, err error) {
 	return
 }
 
-func checkIssueDeadlineForAllCards() {
-	cardsLock.Lock()
-	defer cardsLock.Unlock()
-
-	for _, card := range metaCards {
-		contentURL := card.GetContentURL()
-		if contentURL == "" {
-			// not issue
-			continue
-		}
+func checkIssueDeadlineForAllCards(log *logrus.Entry) {
+	for _, contentURL := range getCardContentURLs() {
 		issueDeadline, err := getIssueDeadlineByURL(contentURL)
 		if err != nil {
-			logrus.Warningf("failed to get issue deadline by url %q: %v", contentURL, err)
+			log.Warningf("failed to get issue deadline by url %q: %v", contentURL, err)
 			continue
 		}
-		if issueDeadline == nil {
+		// the day of the deadline ends in the timezone of the issue.
+		if issueDeadline == nil || !issueDeadline.isPassed() {
 			continue
 		}
-		if isDeadlinePassed(issueDeadline.date) {
-			owner, repo, num, err := parseIssueURL(contentURL)
-			if err != nil {
-				logrus.Warning("failed to parse issue url:", err)
-				continue
-			}
 
-			logrus.Infof("%s/%s %d deadline has passed", owner, repo, num)
-			err = addDelayedLabelToIssueAux(owner, repo, num)
-			if err != nil {
-				logrus.Warning("failed to add delayed label to issue: ", err)
-			}
+		owner, repo, num, err := parseIssueURL(contentURL)
+		if err != nil {
+			log.Warning("failed to parse issue url: ", err)
+			continue
+		}
+		log := log.WithFields(logrus.Fields{"repo": owner + "/" + repo, "issue": num})
+		log.Info("deadline has passed")
+		err = issueExecutor.Run(contentURL, func() error {
+			return addDelayedLabelToIssueAux(log, owner, repo, num)
+		})
+		if err != nil {
+			log.Warning("failed to add delayed label to issue: ", err)
 		}
 	}
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// leaseName is the name of the lease held by the leader.
+const leaseName = "kanbanmgr"
+
+// leaderElector elects the leader among the replicas sharing the database
+// with a lease. Only the leader runs the jobs changing Github and processes
+// the queued webhooks, so the replicas don't double post. The lease is
+// renewed every third of its duration, and a replica gives up the
+// leadership as soon as a renewal fails, before the lease expires and
+// another replica takes it over.
+type leaderElector struct {
+	id    string
+	lease time.Duration
+	// onElected is called when the replica becomes the leader.
+	onElected func()
+
+	mu     sync.Mutex
+	leader bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// elector is nil in the subcommands, which always act as the leader.
+var elector *leaderElector
+
+func newLeaderElector(lease time.Duration) *leaderElector {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &leaderElector{
+		id:    fmt.Sprintf("%s-%d", host, os.Getpid()),
+		lease: lease,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// isLeader reports whether this process is the leader.
+func isLeader() bool {
+	if elector == nil {
+		return true
+	}
+	elector.mu.Lock()
+	defer elector.mu.Unlock()
+	return elector.leader
+}
+
+// tryAcquire takes the lease if it's expired, or renews it if it's held by
+// this replica. The times are in UTC, so they compare as strings in SQLite.
+func (e *leaderElector) tryAcquire(now time.Time) (bool, error) {
+	now = now.UTC()
+	res, err := db.Exec(`UPDATE leader_lease SET holder = ?, expires_at = ?
+		WHERE name = ? AND (holder = ? OR expires_at < ?)`,
+		e.id, now.Add(e.lease), leaseName, e.id, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 1 {
+		return n == 1, err
+	}
+
+	// the lease is created by the first replica.
+	res, err = db.Exec(`INSERT INTO leader_lease (name,holder,expires_at) VALUES (?,?,?)
+		ON CONFLICT DO NOTHING`, leaseName, e.id, now.Add(e.lease))
+	if err != nil {
+		return false, err
+	}
+	n, err = res.RowsAffected()
+	return n == 1, err
+}
+
+// renew tries to take or keep the lease and updates the leadership.
+func (e *leaderElector) renew() {
+	leader, err := e.tryAcquire(time.Now())
+	if err != nil {
+		logrus.Warning("failed to renew the leader lease: ", err)
+	}
+
+	e.mu.Lock()
+	elected := leader && !e.leader
+	changed := leader != e.leader
+	e.leader = leader
+	onElected := e.onElected
+	e.mu.Unlock()
+
+	if changed {
+		if leader {
+			logrus.Infof("%s became the leader", e.id)
+			leaderGauge.Set(1)
+		} else {
+			logrus.Warningf("%s is no longer the leader", e.id)
+			leaderGauge.Set(0)
+		}
+	}
+	if elected && onElected != nil {
+		onElected()
+	}
+}
+
+// Run takes part in the election right away and renews the lease until
+// Stop.
+func (e *leaderElector) Run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	for {
+		e.renew()
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Stop stops renewing the lease and releases it, so another replica takes
+// over without waiting for the lease to expire.
+func (e *leaderElector) Stop() {
+	if !e.Abandon() {
+		return
+	}
+
+	_, err := db.Exec(`UPDATE leader_lease SET expires_at = ? WHERE name = ? AND holder = ?`,
+		time.Now().UTC(), leaseName, e.id)
+	if err != nil {
+		logrus.Warning("failed to release the leader lease: ", err)
+	}
+}
+
+// Abandon stops renewing the lease without releasing it, so another replica
+// only takes over after it expires. Returns whether this replica was the
+// leader.
+func (e *leaderElector) Abandon() bool {
+	close(e.stop)
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	leader := e.leader
+	e.leader = false
+	return leader
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderLease(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	a := &leaderElector{id: "a", lease: 30 * time.Second}
+	b := &leaderElector{id: "b", lease: 30 * time.Second}
+	now := time.Date(2018, 12, 3, 1, 0, 0, 0, time.UTC)
+
+	leader, err := a.tryAcquire(now)
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	leader, err = b.tryAcquire(now.Add(time.Second))
+	assert.Nil(t, err)
+	assert.False(t, leader)
+
+	// a renews the lease before it expires.
+	leader, err = a.tryAcquire(now.Add(10 * time.Second))
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	leader, err = b.tryAcquire(now.Add(35 * time.Second))
+	assert.Nil(t, err)
+	assert.False(t, leader)
+
+	// b takes over after the lease of a expires.
+	leader, err = b.tryAcquire(now.Add(41 * time.Second))
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	leader, err = a.tryAcquire(now.Add(42 * time.Second))
+	assert.Nil(t, err)
+	assert.False(t, leader)
+}
+
+func TestLeaderStop(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	elected := func(e *leaderElector) func() bool {
+		return func() bool {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			return e.leader
+		}
+	}
+	b := &leaderElector{id: "b", lease: 30 * time.Second}
+
+	// a released lease is taken over right away.
+	a := newLeaderElector(30 * time.Second)
+	go a.Run()
+	assert.Eventually(t, elected(a), time.Second, 10*time.Millisecond)
+	a.Stop()
+	leader, err := b.tryAcquire(time.Now())
+	assert.Nil(t, err)
+	assert.True(t, leader)
+
+	// an abandoned lease is kept until it expires.
+	_, err = db.Exec(`UPDATE leader_lease SET expires_at = ?`, time.Now().UTC())
+	assert.Nil(t, err)
+	a = newLeaderElector(30 * time.Second)
+	go a.Run()
+	assert.Eventually(t, elected(a), time.Second, 10*time.Millisecond)
+	assert.True(t, a.Abandon())
+	leader, err = b.tryAcquire(time.Now())
+	assert.Nil(t, err)
+	assert.False(t, leader)
+	leader, err = b.tryAcquire(time.Now().Add(31 * time.Second))
+	assert.Nil(t, err)
+	assert.True(t, leader)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogging applies the log level and format of c.
+func setupLogging(c *Config) error {
+	level, err := logrus.ParseLevel(c.Log.Level)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+	if c.Log.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+	return nil
+}
+
+// issueFields are the log fields of the issue.
+func issueFields(issue *github.Issue) logrus.Fields {
+	fields := logrus.Fields{"issue": issue.GetNumber()}
+	if owner, repo, _, err := parseIssueURL(issue.GetURL()); err == nil {
+		fields["repo"] = owner + "/" + repo
+	}
+	return fields
+}
+
+// cardFields are the log fields of the card, with the column name if it's
+// on the board.
+func cardFields(card *github.ProjectCard) logrus.Fields {
+	fields := logrus.Fields{"card": card.GetID()}
+	if column, ok := getColumnName(card.GetColumnID()); ok {
+		fields["column"] = column
+	}
+	if owner, repo, num, err := parseIssueURL(card.GetContentURL()); err == nil {
+		fields["repo"] = owner + "/" + repo
+		fields["issue"] = num
+	}
+	return fields
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetupLogging(t *testing.T) {
+	oldLevel, oldFormatter, oldOut := logrus.GetLevel(), logrus.StandardLogger().Formatter, logrus.StandardLogger().Out
+	defer func() {
+		logrus.SetLevel(oldLevel)
+		logrus.SetFormatter(oldFormatter)
+		logrus.SetOutput(oldOut)
+	}()
+
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+
+	c := defaultConfig()
+	c.Log.Level = "warning"
+	c.Log.Format = "json"
+	assert.Nil(t, setupLogging(c))
+	assert.Equal(t, logrus.WarnLevel, logrus.GetLevel())
+	logrus.Info("hidden")
+	logrus.WithField("issue", 1).Warning("shown")
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "shown", entry["msg"])
+	assert.Equal(t, float64(1), entry["issue"])
+
+	buf.Reset()
+	c.Log.Level = "debug"
+	c.Log.Format = "text"
+	assert.Nil(t, setupLogging(c))
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	logrus.Debug("shown")
+	assert.Contains(t, buf.String(), `msg=shown`)
+
+	c.Log.Level = "verbose"
+	assert.NotNil(t, setupLogging(c))
+	// the level is kept when the config is invalid.
+	assert.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+}
+
+func TestLogFields(t *testing.T) {
+	issue := &github.Issue{
+		Number: github.Int(12),
+		URL:    github.String("https://api.github.com/repos/linuxdeepin/dde/issues/12"),
+	}
+	assert.Equal(t, logrus.Fields{"issue": 12, "repo": "linuxdeepin/dde"}, issueFields(issue))
+	assert.Equal(t, logrus.Fields{"issue": 0}, issueFields(&github.Issue{}))
+
+	cardsLock.Lock()
+	oldColumns := metaColumns
+	metaColumns = []*github.ProjectColumn{{ID: github.Int64(11), Name: github.String("开发")}}
+	cardsLock.Unlock()
+	defer func() {
+		cardsLock.Lock()
+		metaColumns = oldColumns
+		cardsLock.Unlock()
+	}()
+
+	card := &github.ProjectCard{
+		ID:         github.Int64(101),
+		ColumnID:   github.Int64(11),
+		ContentURL: github.String("https://api.github.com/repos/linuxdeepin/dde/issues/12"),
+	}
+	assert.Equal(t, logrus.Fields{"card": int64(101), "column": "开发", "repo": "linuxdeepin/dde", "issue": 12},
+		cardFields(card))
+
+	// a note on a column not on the board.
+	note := &github.ProjectCard{ID: github.Int64(102), ColumnID: github.Int64(99)}
+	assert.Equal(t, logrus.Fields{"card": int64(102)}, cardFields(note))
+}
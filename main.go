@@ -1,184 +1,367 @@
 package main
 
 import (
-	"database/sql"
+	"flag"
 	"fmt"
-	"github.com/whiteShtef/clockwork"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/github"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	client *github.Client
+	client          *github.Client
+	githubTransport *ghinstallation.Transport
+	scheduler       *jobScheduler
 )
 
-func initGithubData() {
-	var err error
-
-	// setup the github apps client
-	tr := http.DefaultTransport
-	itr, err := ghinstallation.NewKeyFromFile(tr, AppID, AppInstallationID, PEMFilePath)
+// initGithubClient sets up the github apps client.
+func initGithubClient() error {
+	app := config().Github
+	githubRateLimit = newRateLimitTransport(&instrumentedTransport{http.DefaultTransport},
+		time.Duration(app.RequestTimeout)*time.Second, app.RateLimitReserve)
+	itr, err := ghinstallation.NewKeyFromFile(githubRateLimit, app.AppID, app.InstallationID, app.PEMFile)
 	if err != nil {
-		logrus.Fatalf("failed to init %v", err)
+		return err
 	}
+	githubTransport = itr
 	client = github.NewClient(&http.Client{Transport: itr})
+	return nil
+}
 
-	// update metadata
-	err = UpdateTeamsMetadata()
+func initGithubData() {
+	err := initGithubClient()
 	if err != nil {
-		logrus.Fatalf("failed to update teams metadata: %v", err)
+		logrus.Fatalf("failed to init %v", err)
 	}
 
-	err = PrepareKanbanMetadata()
+	err = updateMetadata()
 	if err != nil {
-		logrus.Fatalf("failed to update kanban metadata: %v", err)
+		logrus.Fatal(err)
 	}
 
 	logrus.Printf("initialized successfully.")
 }
 
+func updateMetadata() error {
+	err := UpdateTeamsMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to update teams metadata: %v", err)
+	}
+
+	err = PrepareKanbanMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to update kanban metadata: %v", err)
+	}
+	return nil
+}
+
 func githubWebhooks(rw http.ResponseWriter, r *http.Request) {
 	var event interface{}
+	var action string
+	eventType := github.WebHookType(r)
+	deliveryID := github.DeliveryID(r)
+	log := logrus.WithFields(logrus.Fields{"delivery": deliveryID, "event": eventType})
+	result := webhookIgnored
+	// the event header of an invalid request is untrusted, and isn't used as
+	// a label.
+	eventLabel := webhookInvalid
+	defer func() {
+		webhookDeliveries.WithLabelValues(eventLabel, action, result).Inc()
+	}()
 
-	payload, err := github.ValidatePayload(r, []byte(WebhookSecret))
+	payload, err := github.ValidatePayload(r, []byte(config().Github.WebhookSecret))
 	if err != nil {
-		logrus.Errorf("validate payload failed: %v", err)
+		log.Errorf("validate payload failed: %v", err)
 	} else {
-		event, err = github.ParseWebHook(github.WebHookType(r), payload)
+		event, err = github.ParseWebHook(eventType, payload)
 		if err != nil {
-			logrus.Errorf("parse webhook failed: %v", err)
+			log.Errorf("parse webhook failed: %v", err)
 		}
 	}
 
 	if err != nil {
 		body, _ := ioutil.ReadAll(r.Body)
-		logrus.Errorf("request body: %v", string(body))
+		log.Errorf("request body: %v", string(body))
 
+		result = webhookInvalid
 		rw.WriteHeader(400)
 		rw.Write([]byte(err.Error()))
 		return
 	}
+	eventLabel = eventType
+	if e, ok := event.(interface{ GetAction() string }); ok {
+		action = e.GetAction()
+		log = log.WithField("action", action)
+	}
+
+	// any replica accepts the delivery, the leader processes it.
+	fresh, err := queueDelivery(deliveryID, eventType, payload)
+	if err != nil {
+		log.Error("failed to queue the delivery: ", err)
+		result = webhookUnavailable
+		http.Error(rw, "failed to queue the delivery", http.StatusServiceUnavailable)
+		return
+	}
+	if !fresh {
+		log.Info("the delivery has been processed, skip it")
+		result = webhookDuplicate
+		return
+	}
+	result = webhookQueued
+	queueWorker.Wake()
+}
 
+// applyWebhookEvent updates the issue cache and the cards of this replica
+// with the webhook event taken from the queue. Every replica applies the
+// events, while only the leader handles them.
+func applyWebhookEvent(log *logrus.Entry, action string, event interface{}) {
+	switch event := event.(type) {
+	case *github.IssuesEvent:
+		issue := event.GetIssue()
+		issue.Repository = event.GetRepo()
+		switch action {
+		case "deleted", "transferred":
+			evictIssue(issue.GetURL())
+		default:
+			// the closed issues are kept, so they aren't counted as overdue.
+			cacheIssue(issue)
+		}
+
+	case *github.ProjectCardEvent:
+		if event.GetOrg().GetLogin() != config().Org {
+			break
+		}
+		card := event.GetProjectCard()
+		applyCardEvent(log.WithFields(cardFields(card)), action, card)
+	}
+}
+
+// handleWebhookEvent acts on the webhook event applied by applyWebhookEvent,
+// and returns the result. The issue tasks are waited for, so the webhook is
+// only done when its changes to Github are.
+func handleWebhookEvent(log *logrus.Entry, action string, event interface{}) (string, error) {
 	switch event := event.(type) {
 	case *github.IssuesEvent:
 		// FIXME(hualet): don't know why GetLogin or GetName both returns empty
-		// inTargetOrganization := event.GetRepo().GetOrganization().GetLogin() == OrgName
+		// inTargetOrganization := event.GetRepo().GetOrganization().GetLogin() == config().Org
 		// if !inTargetOrganization {
 		// 	break
 		// }
 
 		issue := event.GetIssue()
 		issue.Repository = event.GetRepo()
-		action := event.GetAction()
+		log = log.WithFields(issueFields(issue))
+		log.Info("issue event received")
 
+		var err error
 		switch action {
 		case "edited":
-			processIssueDeadline(issue)
+			err = issueExecutor.Run(issue.GetURL(), func() error {
+				return processIssueDeadline(log, issue)
+			})
 		case "assigned", "unassigned":
-			handleIssueAssigneeChanged(issue)
+			err = issueExecutor.Run(issue.GetURL(), func() error {
+				return handleIssueAssigneeChanged(log, issue)
+			})
 		}
+		return webhookProcessed, err
 
 	case *github.ProjectCardEvent:
 		card := event.GetProjectCard()
-		action := event.GetAction()
 
-		inTargetOrganization := event.GetOrg().GetLogin() == OrgName
+		inTargetOrganization := event.GetOrg().GetLogin() == config().Org
 		if !inTargetOrganization {
 			break
 		}
+		log = log.WithFields(cardFields(card))
+		log.Info("project card event received")
 
-		logrus.Infof("project card %d %v ", card.GetID(), action)
-
-		switch action {
-		case "created":
-			handleCardCreated(card)
-
-		case "deleted":
-			handleCardDeleted(card)
-
-		case "converted":
-			handleCardConverted(card)
-
-		case "moved":
-			handleCardMoved(card)
+		err := recordCardEvent(action, card)
+		if err != nil {
+			log.Warning("failed to record the transition of the card: ", err)
 		}
+		return webhookProcessed, handleCardEvent(log, action, card)
 	}
+	return webhookIgnored, nil
 }
 
-func handleIssueAssigneeChanged(issue *github.Issue) {
-	var assignees []string
-	for _, ass := range issue.Assignees {
-		assignees = append(assignees, ass.GetLogin())
+func handleIssueAssigneeChanged(log *logrus.Entry, issue *github.Issue) error {
+	// the day of the deadline ends in the timezone of the new assignees.
+	err := updateIssueDeadlineTimezone(issue)
+	if err != nil {
+		return fmt.Errorf("failed to update the timezone of the deadline: %v", err)
 	}
+
 	if len(issue.Assignees) == 1 && issue.GetState() == "open" {
+		board := config().Board
 		assignee := issue.Assignees[0]
 		column, err := GetIssueColumn(issue)
 		if err != nil {
-			return
+			return nil
 		}
-		logrus.Infof("issue %q in column %v is now only assigned to %v",
-			issue.GetTitle(), column.GetName(), assignee.GetLogin())
+		log = log.WithFields(logrus.Fields{"column": column.GetName(), "assignee": assignee.GetLogin()})
+		log.Infof("issue %q is now only assigned to %v", issue.GetTitle(), assignee.GetLogin())
 
 		if CheckUserMemeberOfQATeam(assignee.GetLogin()) &&
-			column.GetName() == DevelopingColumnName {
-			logrus.Infof("moving it to %v", TestingColumnName)
-			err := MoveToTesting(issue)
+			column.GetName() == board.DevelopingColumn {
+			log.Infof("moving it to %v", board.TestingColumn)
+			err := MoveToTesting(log, issue)
 			if err != nil {
-				logrus.Errorf("failed to move issue %q to %v: %v",
-					issue.GetTitle(), TestingColumnName, err)
+				return fmt.Errorf("failed to move issue %q to %v: %v",
+					issue.GetTitle(), board.TestingColumn, err)
 			}
 		} else if CheckUserMemeberOfDevTeam(assignee.GetLogin()) &&
-			column.GetName() == TestingColumnName {
-			logrus.Infof("moving it to %v", DevelopingColumnName)
-			err := MoveToDeveloping(issue)
+			column.GetName() == board.TestingColumn {
+			log.Infof("moving it to %v", board.DevelopingColumn)
+			err := MoveToDeveloping(log, issue)
 			if err != nil {
-				logrus.Errorf("failed to move issue %q to %v: %v",
-					issue.GetTitle(), DevelopingColumnName, err)
+				return fmt.Errorf("failed to move issue %q to %v: %v",
+					issue.GetTitle(), board.DevelopingColumn, err)
 			}
 		}
 	}
+	return nil
 }
 
-var db *sql.DB
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			err := runReplay(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "config":
+			err := runConfig(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "jobs":
+			err := runJobs(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "metrics":
+			err := runMetrics(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "flow":
+			err := runFlow(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "migrate":
+			err := runMigrate(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "export":
+			err := runExport(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "import":
+			err := runImport(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "backfill":
+			err := runBackfill(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		case "deadlines":
+			err := runDeadlines(os.Args[2:])
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			return
+		}
+	}
+
+	registerConfigFlag(flag.CommandLine)
+	dryRun := flag.Bool("dry-run", false, "log and record the changes to Github instead of doing them")
+	flag.Parse()
 
-func initDB() error {
-	var err error
-	db, err = sql.Open("sqlite3", "kanbanmgr.db")
+	c, err := loadConfig(configFile)
 	if err != nil {
-		return err
+		logrus.Fatal("failed to load config: ", err)
 	}
-
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS issue_deadline (
-		id INTEGER PRIMARY KEY NOT NULL,
-		date DATE NOT NULL,
-		url TEXT NOT NULL,
-		directive TEXT NOT NULL
-		)`)
+	forceDryRun = *dryRun
+	if forceDryRun {
+		c.DryRun = true
+	}
+	err = c.Validate()
 	if err != nil {
-		return err
+		logrus.Fatal("invalid config: ", err)
+	}
+	setConfig(c)
+	err = setupLogging(c)
+	if err != nil {
+		logrus.Fatal("failed to set up logging: ", err)
+	}
+	if c.DryRun {
+		logrus.Info("running in dry-run mode")
 	}
 
-	return nil
-}
-
-func main() {
-	var err error
-	err = initDB()
+	err = initDB(c.Database.DSN)
 	if err != nil {
 		logrus.Fatal("failed to init db:", err)
 	}
-	initGithubData()
-	checkIssueDeadlineForAllCards()
+	err = initGithubClient()
+	if err != nil {
+		logrus.Fatal("failed to init github client: ", err)
+	}
 
-	scheduler := clockwork.NewScheduler()
-	scheduler.Schedule().Every().Day().At("1:00").Do(checkIssueDeadlineForAllCards)
-	go scheduler.Run()
+	scheduler = newJobScheduler()
+	elector = newLeaderElector(time.Duration(c.Server.LeaseDuration) * time.Second)
+	elector.onElected = func() {
+		scheduler.CatchUp()
+		queueWorker.Wake()
+	}
+	go elector.Run()
+	err = queueWorker.Start()
+	if err != nil {
+		logrus.Fatal("failed to start the webhook queue: ", err)
+	}
+	go func() {
+		initGithubDataWithRetry()
+		scheduler.Start(config())
+	}()
+	go watchConfigReload()
 
 	http.HandleFunc("/", githubWebhooks)
-	logrus.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", ServePort), nil))
+	http.HandleFunc("/calendar.ics", feedHandler(serveCalendar))
+	http.HandleFunc("/dashboard", feedHandler(serveDashboard))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", serveReadyz)
+	http.HandleFunc("/charts/cfd.svg", feedHandler(serveFlow(chartCFD, "svg")))
+	http.HandleFunc("/charts/burndown.svg", feedHandler(serveFlow(chartBurndown, "svg")))
+	registerAPIHandlers(http.DefaultServeMux)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%v", c.Server.Port)}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			logrus.Fatal(err)
+		}
+	}()
+	waitForShutdown(server, time.Duration(c.Server.ShutdownTimeout)*time.Second)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const metricsNamespace = "kanbanmgr"
+
+// results of the webhook deliveries.
+const (
+	webhookQueued      = "queued"
+	webhookProcessed   = "processed"
+	webhookFailed      = "failed"
+	webhookIgnored     = "ignored"
+	webhookDuplicate   = "duplicate"
+	webhookInvalid     = "invalid"
+	webhookUnavailable = "unavailable"
+)
+
+var (
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries by event, action and result.",
+	}, []string{"event", "action", "result"})
+
+	webhookEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_events_total",
+		Help:      "Queued webhooks processed by the leader by event, action and result.",
+	}, []string{"event", "action", "result"})
+
+	webhookQueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_queue_depth",
+		Help:      "Webhooks waiting for the leader in the queue shared by the replicas.",
+	}, func() float64 {
+		count, err := countQueuedWebhooks()
+		if err != nil {
+			logrus.Warning("failed to count the queued webhooks: ", err)
+		}
+		return float64(count)
+	})
+
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the leader.",
+	})
+
+	githubRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_requests_total",
+		Help:      "Github API requests by method, endpoint and status code.",
+	}, []string{"method", "endpoint", "code"})
+
+	githubRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_request_duration_seconds",
+		Help:      "Latency of the Github API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+
+	githubRateLimitRemaining = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Remaining Github API requests in the current rate limit window.",
+	})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_duration_seconds",
+		Help:      "Duration of the background job runs by job and result.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"job", "result"})
+
+	executorQueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "executor_queue_depth",
+		Help:      "Issue tasks waiting to run in the executor.",
+	}, func() float64 {
+		return float64(issueExecutor.Pending())
+	})
+
+	overdueCardsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "overdue_cards"),
+		"Open issues on the board which are overdue, by column.",
+		[]string{"column"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries, webhookEvents, webhookQueueDepth, leaderGauge,
+		githubRequests, githubRequestDuration, githubRateLimitRemaining, jobDuration,
+		executorQueueDepth, overdueCardsCollector{})
+}
+
+// overdueCardsCollector counts the overdue cards on every scrape, with the
+// issues in the cache only, so a scrape never calls the Github API.
+type overdueCardsCollector struct{}
+
+func (overdueCardsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- overdueCardsDesc
+}
+
+func (overdueCardsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	for _, name := range getTargetColumnNames() {
+		counts[name] = 0
+	}
+
+	for _, bc := range getBoardCards() {
+		contentURL := bc.card.GetContentURL()
+		if contentURL == "" {
+			continue
+		}
+		if issue := getCachedIssue(contentURL); issue != nil && issue.GetState() != "open" {
+			continue
+		}
+		issueDeadline, err := getIssueDeadlineByURL(contentURL)
+		if err != nil {
+			logrus.Warningf("failed to get the deadline of %s: %v", contentURL, err)
+			continue
+		}
+		if issueDeadline != nil && issueDeadline.isPassed() {
+			counts[bc.column]++
+		}
+	}
+
+	for column, count := range counts {
+		ch <- prometheus.MustNewConstMetric(overdueCardsDesc, prometheus.GaugeValue, float64(count), column)
+	}
+}
+
+// instrumentedTransport counts and times the Github API requests, and keeps
+// the remaining rate limit.
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := apiEndpoint(req.URL.Path)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	githubRequestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+			githubRateLimitRemaining.Set(float64(remaining))
+		}
+	}
+	githubRequests.WithLabelValues(req.Method, endpoint, code).Inc()
+	return resp, err
+}
+
+// apiEndpoint replaces the owners, repos and ids in the path with
+// placeholders to keep the label values few.
+func apiEndpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(segments); i++ {
+		switch {
+		case segments[i] == "repos" && i+2 < len(segments):
+			segments[i+1], segments[i+2] = ":owner", ":repo"
+			i += 2
+		case segments[i] == "orgs" && i+1 < len(segments):
+			segments[i+1] = ":org"
+			i++
+		case segments[i] == "labels" && i+1 < len(segments):
+			segments[i+1] = ":name"
+			i++
+		default:
+			if _, err := strconv.ParseInt(segments[i], 10, 64); err == nil {
+				segments[i] = ":id"
+			}
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
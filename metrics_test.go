@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	assert.Equal(t, "/repos/:owner/:repo/issues/:id/labels/:name",
+		apiEndpoint("/repos/linuxdeepin/dde/issues/12/labels/delayed"))
+	assert.Equal(t, "/orgs/:org/projects", apiEndpoint("/orgs/linuxdeepin/projects"))
+	assert.Equal(t, "/projects/columns/:id/cards", apiEndpoint("/projects/columns/367/cards"))
+	assert.Equal(t, "/app/installations/:id/access_tokens", apiEndpoint("/app/installations/42/access_tokens"))
+}
+
+func TestWebhookDeliveriesInvalid(t *testing.T) {
+	old := config()
+	defer setConfig(old)
+	c := defaultConfig()
+	c.Github.WebhookSecret = "secret"
+	setConfig(c)
+
+	invalid := webhookDeliveries.WithLabelValues(webhookInvalid, "", webhookInvalid)
+	before := testutil.ToFloat64(invalid)
+
+	req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "made-up-event")
+	req.Header.Set("X-Hub-Signature", "sha1=0000")
+	rw := httptest.NewRecorder()
+	githubWebhooks(rw, req)
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	// the event of an unverified request isn't a label.
+	assert.Equal(t, before+1, testutil.ToFloat64(invalid))
+	assert.Equal(t, float64(0), testutil.ToFloat64(webhookDeliveries.WithLabelValues("made-up-event", "", webhookInvalid)))
+}
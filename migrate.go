@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// migration changes the schema from the previous version to its version.
+// The migrations are never edited once released, a change of the schema is
+// a new migration appended to the list.
+type migration struct {
+	version     int
+	description string
+	stmts       []string
+	// postgresStmts replace stmts on PostgreSQL if they can't be shared.
+	postgresStmts []string
+}
+
+func (m *migration) statements(d dialect) []string {
+	if _, ok := d.(postgresDialect); ok && m.postgresStmts != nil {
+		return m.postgresStmts
+	}
+	return m.stmts
+}
+
+var migrations = []migration{
+	// the tables are created with IF NOT EXISTS, so the databases created
+	// before the migrations are adopted as version 1.
+	{1, "create the tables", []string{
+		`CREATE TABLE IF NOT EXISTS issue_deadline (
+			id INTEGER PRIMARY KEY NOT NULL,
+			date DATE NOT NULL,
+			url TEXT NOT NULL,
+			directive TEXT NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS bot_action (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME NOT NULL,
+			kind TEXT NOT NULL,
+			target TEXT NOT NULL,
+			detail TEXT NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS job_run (
+			name TEXT PRIMARY KEY NOT NULL,
+			last_run DATETIME NOT NULL,
+			duration_ms INTEGER NOT NULL,
+			error TEXT NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS deadline_reminder (
+			id INTEGER NOT NULL,
+			date TEXT NOT NULL,
+			PRIMARY KEY (id, date)
+			)`,
+		`CREATE TABLE IF NOT EXISTS webhook_delivery (
+			id TEXT PRIMARY KEY NOT NULL,
+			event TEXT NOT NULL,
+			received_at DATETIME NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS card_transition (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			card_id INTEGER NOT NULL,
+			issue_url TEXT NOT NULL,
+			from_column TEXT NOT NULL,
+			to_column TEXT NOT NULL,
+			moved_at DATETIME NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS flow_snapshot (
+			date TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			column_name TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (date, column_name)
+			)`,
+		`CREATE TABLE IF NOT EXISTS burndown_snapshot (
+			date TEXT PRIMARY KEY NOT NULL,
+			remaining INTEGER NOT NULL,
+			with_deadline INTEGER NOT NULL,
+			overdue INTEGER NOT NULL
+			)`,
+	}, nil},
+	{2, "index the deadlines by url and the transitions by card", []string{
+		`CREATE INDEX IF NOT EXISTS issue_deadline_url ON issue_deadline (url)`,
+		`CREATE INDEX IF NOT EXISTS card_transition_card ON card_transition (card_id, moved_at)`,
+	}, nil},
+	{3, "add the leader lease and the webhook queue", []string{
+		`CREATE TABLE IF NOT EXISTS leader_lease (
+			name TEXT PRIMARY KEY NOT NULL,
+			holder TEXT NOT NULL,
+			expires_at DATETIME NOT NULL
+			)`,
+		`CREATE TABLE IF NOT EXISTS webhook_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			delivery TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			received_at DATETIME NOT NULL,
+			claimed_by TEXT NOT NULL DEFAULT '',
+			done_at DATETIME
+			)`,
+		`CREATE INDEX IF NOT EXISTS webhook_queue_pending ON webhook_queue (done_at, id)`,
+	}, nil},
+	// the deadlines were the midnight in the timezone of the issue, which
+	// is shifted to the day before when shown in a timezone to the west.
+	// SQLite kept the offset, so the date is the head of the text, while
+	// PostgreSQL converts them in the timezone of the session. The timezone
+	// the day ends in is kept beside the date instead.
+	{4, "store the deadlines as plain dates with their timezone", []string{
+		`UPDATE issue_deadline SET date = substr(date, 1, 10)`,
+		`ALTER TABLE issue_deadline ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`,
+	}, []string{
+		`ALTER TABLE issue_deadline ALTER COLUMN date TYPE DATE`,
+		`ALTER TABLE issue_deadline ADD COLUMN timezone TEXT NOT NULL DEFAULT ''`,
+	}},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY NOT NULL,
+	description TEXT NOT NULL,
+	applied_at DATETIME NOT NULL
+	)`
+
+func getSchemaVersion(q querier) (int, error) {
+	var version int
+	err := q.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// migrateDB runs the migrations newer than the schema of the database, each
+// in its own transaction. A database newer than the bot is refused, since
+// the bot doesn't know how to use it.
+func migrateDB() error {
+	_, err := db.Exec(db.dialect.ddl(schemaVersionTable))
+	if err != nil {
+		return err
+	}
+
+	version, err := getSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("schema version %d of the database is newer than %d supported by this kanbanmgr",
+			version, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		err = applyMigration(m)
+		if err != nil {
+			return fmt.Errorf("failed to migrate to version %d: %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the replicas starting at the same time migrate one by one, the ones
+	// waiting for the lock find the migration done.
+	if lock := tx.dialect.lockTable("schema_version"); lock != "" {
+		_, err = tx.Exec(lock)
+		if err != nil {
+			return err
+		}
+	}
+	version, err := getSchemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version >= m.version {
+		return nil
+	}
+
+	for _, stmt := range m.statements(tx.dialect) {
+		_, err = tx.Exec(tx.dialect.ddl(stmt))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version (version,description,applied_at) VALUES (?,?,?)`,
+		m.version, m.description, time.Now())
+	if err != nil {
+		return err
+	}
+	logrus.Infof("migrated the database to version %d: %s", m.version, m.description)
+	return tx.Commit()
+}
+
+type migrationStatus struct {
+	Version     int
+	Description string
+	// AppliedAt is zero if the migration is pending.
+	AppliedAt time.Time
+}
+
+func listMigrationStatus() ([]*migrationStatus, error) {
+	_, err := db.Exec(db.dialect.ddl(schemaVersionTable))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version,description,applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]*migrationStatus)
+	var unknown []*migrationStatus
+	for rows.Next() {
+		var status migrationStatus
+		err = rows.Scan(&status.Version, &status.Description, &status.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[status.Version] = &status
+		if status.Version > latestSchemaVersion() {
+			unknown = append(unknown, &status)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ret []*migrationStatus
+	for _, m := range migrations {
+		if status, ok := applied[m.version]; ok {
+			ret = append(ret, status)
+		} else {
+			ret = append(ret, &migrationStatus{Version: m.version, Description: m.description})
+		}
+	}
+	return append(ret, unknown...), nil
+}
+
+// runMigrate implements the migrate subcommand, status prints the migrations
+// and up runs the pending ones, which the bot also does at startup.
+func runMigrate(args []string) error {
+	if len(args) == 0 || (args[0] != "status" && args[0] != "up") {
+		return fmt.Errorf("usage: %s migrate status|up [-config kanbanmgr.yml]", os.Args[0])
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	registerConfigFlag(flags)
+	flags.Parse(args[1:])
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = openDB(c.Database.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if args[0] == "up" {
+		err = migrateDB()
+		if err != nil {
+			return err
+		}
+	}
+
+	statuses, err := listMigrationStatus()
+	if err != nil {
+		return err
+	}
+	loc := c.boardLocation()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := formatStatusTime(status.AppliedAt, loc)
+		if status.AppliedAt.IsZero() {
+			appliedAt = "pending"
+		}
+		if status.Version > latestSchemaVersion() {
+			appliedAt += " (unknown to this kanbanmgr)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Description, appliedAt)
+	}
+	return w.Flush()
+}
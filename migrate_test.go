@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateDB(t *testing.T) {
+	assert.Nil(t, openDB(":memory:"))
+	defer db.Close()
+
+	// a database created before the migrations, with a deadline stored as
+	// the midnight in the timezone of the issue.
+	_, err := db.Exec(migrations[0].stmts[0])
+	assert.Nil(t, err)
+	date := time.Date(2018, 12, 3, 0, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	_, err = db.Exec(`INSERT INTO issue_deadline (id,date,url,directive) VALUES (?,?,?,?)`,
+		1, date, "https://api.github.com/repos/a/b/issues/1", "3")
+	assert.Nil(t, err)
+
+	statuses, err := listMigrationStatus()
+	assert.Nil(t, err)
+	assert.Len(t, statuses, len(migrations))
+	assert.True(t, statuses[0].AppliedAt.IsZero())
+
+	assert.Nil(t, migrateDB())
+	version, err := getSchemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, latestSchemaVersion(), version)
+	issueDeadline, err := getIssueDeadline(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", issueDeadline.directive)
+	assert.Equal(t, time.Date(2018, 12, 3, 0, 0, 0, 0, time.UTC), issueDeadline.date)
+
+	// migrating again changes nothing.
+	assert.Nil(t, migrateDB())
+	statuses, err = listMigrationStatus()
+	assert.Nil(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+
+	_, err = db.Exec(`INSERT INTO schema_version (version,description,applied_at) VALUES (?,?,?)`,
+		latestSchemaVersion()+1, "from the future", time.Now())
+	assert.Nil(t, err)
+	assert.NotNil(t, migrateDB())
+	statuses, err = listMigrationStatus()
+	assert.Nil(t, err)
+	assert.Len(t, statuses, len(migrations)+1)
+}
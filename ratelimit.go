@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// secondaryLimitRetries is how many times a request hitting the
+	// secondary rate limit is retried.
+	secondaryLimitRetries = 3
+	// maxRetryAfter caps the wait of a Retry-After header.
+	maxRetryAfter = 2 * time.Minute
+)
+
+// rateLimitTransport tracks the rate limit of the Github API, waits for the
+// reset when it's used up, retries the requests hitting the secondary rate
+// limit after Retry-After, and applies the timeout to every attempt.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	reserve int
+
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+// githubRateLimit is the transport of the github client, nil when the
+// client doesn't talk to Github.
+var githubRateLimit *rateLimitTransport
+
+func newRateLimitTransport(base http.RoundTripper, timeout time.Duration, reserve int) *rateLimitTransport {
+	return &rateLimitTransport{
+		base:      base,
+		timeout:   timeout,
+		reserve:   reserve,
+		remaining: -1,
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.waitForReset(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	for retry := 0; ; retry++ {
+		resp, err := t.roundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		t.update(resp.Header)
+
+		wait, ok := retryAfter(resp)
+		if !ok || retry >= secondaryLimitRetries {
+			return resp, nil
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+
+		logrus.Warningf("secondary rate limit hit by %s %s, retry in %v", req.Method, req.URL.Path, wait)
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// roundTrip sends the request once with the timeout, which is canceled when
+// the response body is closed.
+func (t *rateLimitTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryAfter returns the wait of a response hitting the secondary rate
+// limit, which is a 403 or 429 with a Retry-After header.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
+
+func (t *rateLimitTransport) update(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remaining = remaining
+	t.reset = time.Unix(reset, 0)
+}
+
+// budget returns the remaining rate limit and when it resets, remaining is
+// -1 if no response has told it yet.
+func (t *rateLimitTransport) budget() (remaining int, reset time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.remaining >= 0 && !time.Now().Before(t.reset) {
+		return -1, time.Time{}
+	}
+	return t.remaining, t.reset
+}
+
+// waitForReset blocks until the reset if the rate limit is used up.
+func (t *rateLimitTransport) waitForReset(ctx context.Context) error {
+	remaining, reset := t.budget()
+	if remaining != 0 {
+		return nil
+	}
+
+	logrus.Warningf("github rate limit is used up, wait until %v", reset)
+	select {
+	case <-time.After(time.Until(reset)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForBudget delays the low priority work of name until the reset when
+// the remaining rate limit is under the reserve, or until ctx is done.
+func (t *rateLimitTransport) waitForBudget(ctx context.Context, name string) error {
+	if t == nil {
+		return nil
+	}
+	remaining, reset := t.budget()
+	if remaining < 0 || remaining >= t.reserve {
+		return nil
+	}
+
+	logrus.Infof("github rate limit remaining %d is under the reserve %d, delay %s until %v",
+		remaining, t.reserve, name, reset)
+	select {
+	case <-time.After(time.Until(reset)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
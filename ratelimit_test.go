@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Unix()
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		rw.Header().Set("X-RateLimit-Remaining", "42")
+		rw.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		switch r.URL.Path {
+		case "/abuse":
+			if len(bodies) < 3 {
+				rw.Header().Set("Retry-After", "0")
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	tr := newRateLimitTransport(http.DefaultTransport, 100*time.Millisecond, 100)
+	client := &http.Client{Transport: tr}
+
+	resp, err := client.Post(server.URL+"/abuse", "text/plain", strings.NewReader("payload"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+
+	remaining, resetAt := tr.budget()
+	assert.Equal(t, 42, remaining)
+	assert.Equal(t, reset, resetAt.Unix())
+
+	_, err = client.Get(server.URL + "/slow")
+	assert.NotNil(t, err)
+}
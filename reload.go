@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// forceDryRun is set by the -dry-run flag, which takes precedence over the
+// config file when reloading.
+var forceDryRun bool
+
+// reloadConfig loads the config file again and swaps it in if it's valid.
+// The kanban and teams metadata are fetched with the new config before the
+// swap, so the config and the metadata are always consistent.
+func reloadConfig() error {
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if forceDryRun {
+		c.DryRun = true
+	}
+	err = c.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+
+	old := config()
+	if c.Github != old.Github {
+		logrus.Warning("github app settings changed, restart to apply them")
+		c.Github = old.Github
+	}
+	if c.Server != old.Server {
+		logrus.Warning("server settings changed, restart to apply them")
+		c.Server = old.Server
+	}
+	if c.Database != old.Database {
+		logrus.Warning("database settings changed, restart to apply them")
+		c.Database = old.Database
+	}
+
+	boardChanged := c.Org != old.Org || !reflect.DeepEqual(c.Board, old.Board)
+	teamsChanged := c.Org != old.Org || c.Teams != old.Teams
+
+	var cards []*github.ProjectCard
+	var columns []*github.ProjectColumn
+	if boardChanged {
+		cards, columns, err = fetchKanbanMetadata(c)
+		if err != nil {
+			return fmt.Errorf("failed to update kanban metadata: %v", err)
+		}
+	}
+	var teams []*team
+	if teamsChanged {
+		teams, err = fetchTeamsMetadata(c)
+		if err != nil {
+			return fmt.Errorf("failed to update teams metadata: %v", err)
+		}
+	}
+
+	cardsLock.Lock()
+	teamsLock.Lock()
+	if boardChanged {
+		metaCards = cards
+		metaColumns = columns
+	}
+	if teamsChanged {
+		metaTeams = teams
+	}
+	setConfig(c)
+	teamsLock.Unlock()
+	cardsLock.Unlock()
+
+	err = setupLogging(c)
+	if err != nil {
+		logrus.Warning("failed to set up logging: ", err)
+	}
+
+	if boardChanged {
+		markKanbanLoaded()
+	}
+	if teamsChanged {
+		markTeamsLoaded()
+	}
+
+	logrus.Infof("config reloaded from %s", configFile)
+	if scheduler != nil {
+		scheduler.Reschedule(c)
+	}
+	if boardChanged && isLeader() {
+		checkIssueDeadlineForAllCards(logrus.WithField("reload", configFile))
+	}
+	return nil
+}
+
+// watchConfigReload reloads the config on SIGHUP.
+func watchConfigReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := reloadConfig()
+		if err != nil {
+			logrus.Error("failed to reload config, keep using the old one: ", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	oldConfig, oldConfigFile, oldClient := config(), configFile, client
+	defer func() {
+		setConfig(oldConfig)
+		configFile = oldConfigFile
+		client = oldClient
+		forceDryRun = false
+	}()
+
+	// the board is only fetched if the board settings change.
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(rw, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		switch r.URL.Path {
+		case "/orgs/linuxdeepin/projects":
+			rw.Write([]byte(`[{"id":1,"name":"deepin 看板"}]`))
+		case "/projects/1/columns":
+			rw.Write([]byte(`[{"id":11,"name":"开发"},{"id":12,"name":"测试"}]`))
+		case "/projects/columns/11/cards":
+			rw.Write([]byte(`[{"id":101,"content_url":"https://api.github.com/repos/linuxdeepin/dde/issues/1"}]`))
+		default:
+			rw.Write([]byte(`[]`))
+		}
+	}))
+	defer server.Close()
+	client = github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	dir, err := ioutil.TempDir("", "kanbanmgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pemFile := filepath.Join(dir, "app.pem")
+	assert.Nil(t, ioutil.WriteFile(pemFile, nil, 0600))
+	configFile = filepath.Join(dir, "kanbanmgr.yml")
+	write := func(extra string) {
+		err := ioutil.WriteFile(configFile, []byte(`
+github:
+  installation_id: 1
+  pem_file: `+pemFile+`
+`+extra), 0644)
+		assert.Nil(t, err)
+	}
+
+	write("")
+	c, err := loadConfig(configFile)
+	assert.Nil(t, err)
+	setConfig(c)
+	cardsLock.Lock()
+	metaCards, metaColumns = nil, nil
+	cardsLock.Unlock()
+
+	// the settings applied on restart are kept.
+	write(`
+server:
+  port: 8080
+database:
+  dsn: /var/lib/kanbanmgr/other.db
+api:
+  tokens: ["0123456789abcdef"]
+`)
+	assert.Nil(t, reloadConfig())
+	assert.Equal(t, []string{"0123456789abcdef"}, config().API.Tokens)
+	assert.Equal(t, c.Server.Port, config().Server.Port)
+	assert.Equal(t, c.Database.DSN, config().Database.DSN)
+	assert.False(t, config().DryRun)
+	assert.Empty(t, getBoardCards())
+
+	forceDryRun = true
+	assert.Nil(t, reloadConfig())
+	assert.True(t, config().DryRun)
+
+	// an invalid config is refused.
+	write(`
+board:
+  testing_column: 开发
+`)
+	assert.NotNil(t, reloadConfig())
+	assert.Equal(t, "测试", config().Board.TestingColumn)
+
+	// so is a board which can't be fetched.
+	write(`
+board:
+  project: deepin 看板
+`)
+	failing = true
+	assert.NotNil(t, reloadConfig())
+	assert.Equal(t, c.Board.Project, config().Board.Project)
+
+	failing = false
+	assert.Nil(t, reloadConfig())
+	assert.Equal(t, "deepin 看板", config().Board.Project)
+	cards := getBoardCards()
+	if assert.Len(t, cards, 1) {
+		assert.Equal(t, int64(101), cards[0].card.GetID())
+		assert.Equal(t, "开发", cards[0].column)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// remindDeadlines comments on the open issues due today to remind the
+// assignees, every issue is reminded at most once a day.
+func remindDeadlines() error {
+	log := logrus.WithField("job", "reminders")
+	now := time.Now()
+
+	for _, contentURL := range getCardContentURLs() {
+		issueDeadline, err := getIssueDeadlineByURL(contentURL)
+		if err != nil {
+			return err
+		}
+		if issueDeadline == nil {
+			continue
+		}
+		// today is the day in the timezone the deadline ends in.
+		today := formatDate(now.In(issueDeadline.location()))
+		if formatDate(issueDeadline.date) != today {
+			continue
+		}
+
+		reminded, err := isDeadlineReminded(issueDeadline.id, today)
+		if err != nil {
+			return err
+		}
+		if reminded {
+			continue
+		}
+
+		owner, repo, num, err := parseIssueURL(contentURL)
+		if err != nil {
+			log.Warning("failed to parse issue url: ", err)
+			continue
+		}
+		log := log.WithFields(logrus.Fields{"repo": owner + "/" + repo, "issue": num})
+		err = issueExecutor.Run(contentURL, func() error {
+			return remindIssueDeadline(log, issueDeadline, today)
+		})
+		if err != nil {
+			log.Warning("failed to remind the deadline: ", err)
+		}
+	}
+	return nil
+}
+
+// remindIssueDeadline comments on the issue if it's still open and records
+// the reminder of the day.
+func remindIssueDeadline(log *logrus.Entry, issueDeadline *IssueDeadline, today string) error {
+	issue, err := fetchIssue(issueDeadline.url)
+	if err != nil {
+		return err
+	}
+	if issue.GetState() != "open" {
+		return nil
+	}
+
+	var mentions []string
+	for _, assignee := range issue.Assignees {
+		mentions = append(mentions, "@"+assignee.GetLogin())
+	}
+	commentBody := fmt.Sprintf("%s 今天（%s）是截止日期，请及时完成。",
+		strings.Join(mentions, " "), today)
+	err = createIssueComment(log, issue, strings.TrimSpace(commentBody))
+	if err != nil {
+		return err
+	}
+	return addDeadlineReminder(issueDeadline.id, today)
+}
+
+func isDeadlineReminded(id int64, date string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM deadline_reminder WHERE id = ? AND date = ?`,
+		id, date).Scan(&count)
+	return count > 0, err
+}
+
+// listDeadlineReminders returns the dates the reminders of the deadline
+// were posted.
+func listDeadlineReminders(id int64) ([]string, error) {
+	rows, err := db.Query(`SELECT date FROM deadline_reminder WHERE id = ? ORDER BY date`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []string
+	for rows.Next() {
+		var date string
+		err = rows.Scan(&date)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, date)
+	}
+	return ret, rows.Err()
+}
+
+func addDeadlineReminder(id int64, date string) error {
+	_, err := db.Exec(`INSERT INTO deadline_reminder (id,date) VALUES (?,?)
+		ON CONFLICT DO NOTHING`, id, date)
+	return err
+}
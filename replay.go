@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// savedDelivery is the format of a saved webhook delivery, the headers and
+// the payload can be copied from the "Recent Deliveries" of the app settings.
+type savedDelivery struct {
+	Headers map[string]string `json:"headers"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+func loadSavedDelivery(filename string) (*savedDelivery, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var delivery savedDelivery
+	err = json.Unmarshal(data, &delivery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse delivery file %q: %v", filename, err)
+	}
+	if len(delivery.Payload) == 0 {
+		return nil, fmt.Errorf("no payload in delivery file %q", filename)
+	}
+	return &delivery, nil
+}
+
+// queuedWebhook returns the delivery in the form taken from the queue.
+func (d *savedDelivery) queuedWebhook() *queuedWebhook {
+	header := make(http.Header)
+	for key, value := range d.Headers {
+		header.Set(key, value)
+	}
+	return &queuedWebhook{
+		delivery: header.Get("X-GitHub-Delivery"),
+		event:    header.Get("X-GitHub-Event"),
+		payload:  string(d.Payload),
+	}
+}
+
+// replayDelivery applies and handles the saved delivery right away. It
+// bypasses the queue shared with the running replicas, so only the replayed
+// delivery is processed, and the record of the deliveries, so a delivery
+// seen before is replayed too.
+func replayDelivery(filename string) error {
+	delivery, err := loadSavedDelivery(filename)
+	if err != nil {
+		return err
+	}
+
+	log, action, event, err := parseQueuedWebhook(delivery.queuedWebhook())
+	if err != nil {
+		return fmt.Errorf("delivery %q is invalid: %v", filename, err)
+	}
+	applyWebhookEvent(log, action, event)
+	result, err := handleWebhookEvent(log, action, event)
+	if err != nil {
+		return fmt.Errorf("failed to handle delivery %q: %v", filename, err)
+	}
+	log.Infof("delivery %s", result)
+	return nil
+}
+
+// runReplay implements the replay subcommand, which feeds saved webhook
+// deliveries through the webhook handler.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "simulate against the fake board instead of Github")
+	boardFile := flags.String("board", "", "json file describing the fake board used by -dry-run")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay [-dry-run -board board.json] delivery.json...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	registerConfigFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no delivery file given")
+	}
+
+	c, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	err = setupLogging(c)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		if *boardFile == "" {
+			return errors.New("-dry-run requires -board")
+		}
+		// no need to talk to Github when simulating.
+		err = joinProblems(c.validateBoard())
+		if err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+		setConfig(c)
+
+		var stop func()
+		client, stop, err = newFakeBoardClient(*boardFile, os.Stdout)
+		if err != nil {
+			return err
+		}
+		defer stop()
+
+		// keep the state of the simulation away from the real db.
+		err = initDB(":memory:")
+		if err != nil {
+			return err
+		}
+		err = updateMetadata()
+		if err != nil {
+			return err
+		}
+	} else {
+		err = c.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+		setConfig(c)
+
+		err = initDB(c.Database.DSN)
+		if err != nil {
+			return err
+		}
+		initGithubData()
+	}
+
+	for _, filename := range flags.Args() {
+		fmt.Printf("replaying %s\n", filename)
+		err := replayDelivery(filename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayDelivery(t *testing.T) {
+	const (
+		repoURL  = "https://api.github.com/repos/linuxdeepin/dde"
+		issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	)
+	var out bytes.Buffer
+	board := &fakeBoard{
+		out:      &out,
+		Projects: []*fakeProject{{ID: 1, Name: config().Board.Project}},
+		Columns: []*fakeColumn{
+			{ID: 11, ProjectID: 1, Name: config().Board.DevelopingColumn},
+			{ID: 12, ProjectID: 1, Name: config().Board.TestingColumn},
+		},
+		Cards: []*fakeCard{{ID: 101, ColumnID: 11, ContentURL: issueURL}},
+		Issues: []*github.Issue{
+			{ID: github.Int64(1001), Number: github.Int(1), URL: github.String(issueURL),
+				RepositoryURL: github.String(repoURL), Title: github.String("<2018-12-01> fix the crash")},
+		},
+	}
+	var stop func()
+	client, stop = board.newClient()
+	defer stop()
+
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+	assert.Nil(t, PrepareKanbanMetadata())
+
+	dir, err := ioutil.TempDir("", "kanbanmgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	edited := filepath.Join(dir, "edited.json")
+	assert.Nil(t, ioutil.WriteFile(edited, []byte(`{
+		"headers": {"X-GitHub-Event": "issues", "X-GitHub-Delivery": "d1"},
+		"payload": {"action": "edited",
+			"issue": {"id": 1001, "number": 1, "url": "`+issueURL+`", "repository_url": "`+repoURL+`",
+				"title": "<2018-12-01> fix the crash"},
+			"repository": {"name": "dde", "owner": {"login": "linuxdeepin"}}}
+	}`), 0644))
+	invalid := filepath.Join(dir, "invalid.json")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte(`{
+		"headers": {"X-GitHub-Event": "issues", "X-GitHub-Delivery": "d2"},
+		"payload": []
+	}`), 0644))
+
+	// the delivery has been received by the bot, it's replayed anyway.
+	_, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.Nil(t, replayDelivery(edited))
+	assert.Contains(t, out.String(), "comment on linuxdeepin/dde#1: 设置截止日期到 2018-12-01")
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, "<2018-12-01>", issueDeadline.directive)
+
+	// the replayed delivery doesn't go through the queue of the replicas.
+	count, err := countQueuedWebhooks()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	assert.NotNil(t, replayDelivery(invalid))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// digest is the summary of the board health, the weekly one also reviews
+// the issues done and added in the past week.
+type digest struct {
+	Title       string
+	Date        string
+	StuckDays   int
+	Overdue     []*assigneeIssues
+	DueToday    []*trackedIssue
+	DueThisWeek []*trackedIssue
+	NoDeadline  []*trackedIssue
+	Stuck       []*trackedIssue
+	Weekly      bool
+	DoneInWeek  []*issueFlow
+	AddedInWeek []*issueFlow
+
+	now time.Time
+}
+
+// Days returns the whole days from since to the time of the digest.
+func (d *digest) Days(since time.Time) int {
+	return int(d.now.Sub(since).Hours() / 24)
+}
+
+type assigneeIssues struct {
+	Assignee string
+	Issues   []*trackedIssue
+}
+
+// buildDigest groups the open issues by their deadlines, now must be in the
+// board timezone. The flows are only used by the weekly digest.
+func buildDigest(kind string, issues []*trackedIssue, flows []*issueFlow, now time.Time, stuckDays int) *digest {
+	today := plainDate(now)
+	endOfWeek := getDateInWeek(today, 7)
+
+	d := &digest{
+		Title:     "看板日报",
+		Date:      formatDate(today),
+		StuckDays: stuckDays,
+		now:       now,
+	}
+	if kind == digestWeekly {
+		d.Title = "看板周报"
+		d.Weekly = true
+		weekAgo := now.AddDate(0, 0, -7)
+		for _, flow := range flows {
+			if flow.isDone() && !flow.Done.Before(weekAgo) {
+				d.DoneInWeek = append(d.DoneInWeek, flow)
+			}
+			if !flow.Added.Before(weekAgo) {
+				d.AddedInWeek = append(d.AddedInWeek, flow)
+			}
+		}
+	}
+
+	overdue := make(map[string][]*trackedIssue)
+	for _, issue := range issues {
+		if issue.State != "open" {
+			continue
+		}
+
+		if !issue.hasDeadline() {
+			d.NoDeadline = append(d.NoDeadline, issue)
+		} else {
+			deadline := plainDate(issue.Deadline)
+			switch {
+			case issue.isOverdueAt(now):
+				assignees := issue.Assignees
+				if len(assignees) == 0 {
+					assignees = []string{""}
+				}
+				for _, assignee := range assignees {
+					overdue[assignee] = append(overdue[assignee], issue)
+				}
+			case formatDate(deadline) == d.Date:
+				d.DueToday = append(d.DueToday, issue)
+			case !deadline.After(endOfWeek):
+				d.DueThisWeek = append(d.DueThisWeek, issue)
+			}
+		}
+
+		since := issue.InColumnSince
+		if !since.IsZero() && now.Sub(since) > time.Duration(stuckDays)*24*time.Hour {
+			d.Stuck = append(d.Stuck, issue)
+		}
+	}
+
+	var assignees []string
+	for assignee := range overdue {
+		assignees = append(assignees, assignee)
+	}
+	sort.Strings(assignees)
+	for _, assignee := range assignees {
+		d.Overdue = append(d.Overdue, &assigneeIssues{assignee, overdue[assignee]})
+	}
+	return d
+}
+
+var digestFuncs = map[string]interface{}{
+	"date": func(t time.Time) string {
+		return formatDate(t)
+	},
+	"cycleTime": func(flow *issueFlow) string {
+		return formatHours(flow.cycleTime().Hours())
+	},
+	"assignee": func(login string) string {
+		if login == "" {
+			return "未指派"
+		}
+		return "@" + login
+	},
+	"assignees": func(logins []string) string {
+		if len(logins) == 0 {
+			return "未指派"
+		}
+		return "@" + strings.Join(logins, " @")
+	},
+}
+
+var digestMarkdown = template.Must(template.New("digest").Funcs(digestFuncs).Parse(
+	`## {{.Title}} {{.Date}}
+{{define "issue"}}- [{{.Ref}}]({{.HTMLURL}}) {{.Title}}（{{.Column}}）{{end}}
+### 已延期
+{{range .Overdue}}- {{assignee .Assignee}}
+{{range .Issues}}  {{template "issue" .}} 截止 {{date .Deadline}}
+{{end}}{{else}}无
+{{end}}
+### 今天截止
+{{range .DueToday}}{{template "issue" .}} {{assignees .Assignees}}
+{{else}}无
+{{end}}
+### 本周截止
+{{range .DueThisWeek}}{{template "issue" .}} 截止 {{date .Deadline}} {{assignees .Assignees}}
+{{else}}无
+{{end}}
+### 没有截止日期
+{{range .NoDeadline}}{{template "issue" .}} {{assignees .Assignees}}
+{{else}}无
+{{end}}
+### 在同一列停留超过 {{.StuckDays}} 天
+{{range .Stuck}}{{template "issue" .}} {{$.Days .InColumnSince}} 天 {{assignees .Assignees}}
+{{else}}无
+{{end}}{{if .Weekly}}
+### 本周完成
+{{range .DoneInWeek}}- {{.Ref}} 周期 {{cycleTime .}}
+{{else}}无
+{{end}}
+### 本周新增
+{{range .AddedInWeek}}- {{.Ref}}
+{{else}}无
+{{end}}{{end}}`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Funcs(digestFuncs).Parse(
+	`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}} {{.Date}}</title></head>
+<body>
+<h2>{{.Title}} {{.Date}}</h2>
+{{define "issue"}}<a href="{{.HTMLURL}}">{{.Ref}}</a> {{.Title}}（{{.Column}}）{{end}}
+<h3>已延期</h3>
+<ul>{{range .Overdue}}
+<li>{{assignee .Assignee}}<ul>{{range .Issues}}
+<li>{{template "issue" .}} 截止 {{date .Deadline}}</li>{{end}}
+</ul></li>{{else}}<li>无</li>{{end}}
+</ul>
+<h3>今天截止</h3>
+<ul>{{range .DueToday}}
+<li>{{template "issue" .}} {{assignees .Assignees}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+<h3>本周截止</h3>
+<ul>{{range .DueThisWeek}}
+<li>{{template "issue" .}} 截止 {{date .Deadline}} {{assignees .Assignees}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+<h3>没有截止日期</h3>
+<ul>{{range .NoDeadline}}
+<li>{{template "issue" .}} {{assignees .Assignees}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+<h3>在同一列停留超过 {{.StuckDays}} 天</h3>
+<ul>{{range .Stuck}}
+<li>{{template "issue" .}} {{$.Days .InColumnSince}} 天 {{assignees .Assignees}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+{{if .Weekly}}<h3>本周完成</h3>
+<ul>{{range .DoneInWeek}}
+<li>{{.Ref}} 周期 {{cycleTime .}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+<h3>本周新增</h3>
+<ul>{{range .AddedInWeek}}
+<li>{{.Ref}}</li>{{else}}<li>无</li>{{end}}
+</ul>
+{{end}}</body>
+</html>
+`))
+
+func (d *digest) markdown() (string, error) {
+	var buf bytes.Buffer
+	err := digestMarkdown.Execute(&buf, d)
+	return buf.String(), err
+}
+
+func (d *digest) html() (string, error) {
+	var buf bytes.Buffer
+	err := digestHTML.Execute(&buf, d)
+	return buf.String(), err
+}
+
+// publishDigest generates the digest of the kind, then posts it to the
+// tracking issue and writes it to the output directory.
+func publishDigest(kind string) error {
+	log := logrus.WithField("digest", kind)
+	c := config()
+	if c.Reports.TrackingIssue == "" && c.Reports.OutputDir == "" {
+		return fmt.Errorf("neither reports.tracking_issue nor reports.output_dir is configured")
+	}
+
+	issues, err := getTrackedIssues()
+	if err != nil {
+		return err
+	}
+	var flows []*issueFlow
+	now := time.Now().In(c.boardLocation())
+	if kind == digestWeekly {
+		transitions, err := listCardTransitions()
+		if err != nil {
+			return err
+		}
+		flows = buildIssueFlows(transitions, c.Board, now)
+	}
+	d := buildDigest(kind, issues, flows, now, c.Reports.StuckDays)
+
+	markdown, err := d.markdown()
+	if err != nil {
+		return err
+	}
+
+	if c.Reports.OutputDir != "" {
+		content := markdown
+		ext := ".md"
+		if c.Reports.Format == "html" {
+			content, err = d.html()
+			if err != nil {
+				return err
+			}
+			ext = ".html"
+		}
+
+		filename := filepath.Join(c.Reports.OutputDir, fmt.Sprintf("%s-%s%s", kind, d.Date, ext))
+		err = os.MkdirAll(c.Reports.OutputDir, 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			return err
+		}
+		log.Infof("digest is written to %s", filename)
+	}
+
+	if c.Reports.TrackingIssue != "" {
+		owner, repo, num, err := parseIssueRef(c.Reports.TrackingIssue)
+		if err != nil {
+			return err
+		}
+		err = createIssueCommentAux(log, owner, repo, num, markdown)
+		if err != nil {
+			return err
+		}
+		log.Infof("digest is posted to %s", c.Reports.TrackingIssue)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildDigest(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.Nil(t, err)
+	// Tuesday
+	now := time.Date(2018, 12, 4, 9, 0, 0, 0, loc)
+	day := func(d int) time.Time {
+		return time.Date(2018, 12, d, 0, 0, 0, 0, loc)
+	}
+
+	issues := []*trackedIssue{
+		{Ref: "o/r#1", State: "open", Assignees: []string{"alice"}, Deadline: day(2), InColumnSince: now},
+		{Ref: "o/r#2", State: "open", Deadline: day(1), InColumnSince: now},
+		{Ref: "o/r#3", State: "open", Assignees: []string{"bob"}, Deadline: day(4), InColumnSince: now},
+		{Ref: "o/r#4", State: "open", Deadline: day(9), InColumnSince: now},
+		{Ref: "o/r#5", State: "open", Deadline: day(10), InColumnSince: now},
+		{Ref: "o/r#6", State: "open", InColumnSince: now.AddDate(0, 0, -8)},
+		{Ref: "o/r#7", State: "closed", Deadline: day(1)},
+	}
+
+	d := buildDigest(digestDaily, issues, nil, now, 7)
+	assert.Equal(t, "2018-12-04", d.Date)
+	assert.Len(t, d.Overdue, 2)
+	assert.Equal(t, "", d.Overdue[0].Assignee)
+	assert.Equal(t, "o/r#2", d.Overdue[0].Issues[0].Ref)
+	assert.Equal(t, "alice", d.Overdue[1].Assignee)
+	assert.Len(t, d.DueToday, 1)
+	assert.Equal(t, "o/r#3", d.DueToday[0].Ref)
+	assert.Len(t, d.DueThisWeek, 1)
+	assert.Equal(t, "o/r#4", d.DueThisWeek[0].Ref)
+	assert.Len(t, d.NoDeadline, 1)
+	assert.Len(t, d.Stuck, 1)
+	assert.Equal(t, "o/r#6", d.Stuck[0].Ref)
+
+	markdown, err := d.markdown()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(markdown, "## 看板日报 2018-12-04"))
+	assert.Contains(t, markdown, "- @alice\n  - [o/r#1]")
+
+	assert.Contains(t, markdown, "[o/r#6]() （） 8 天")
+	assert.NotContains(t, markdown, "本周完成")
+
+	_, err = d.html()
+	assert.Nil(t, err)
+
+	// the weekly digest reviews the past week.
+	hour := func(d, h int) time.Time {
+		return time.Date(2018, 12, d, h, 0, 0, 0, loc)
+	}
+	flows := []*issueFlow{
+		{Ref: "o/r#8", Added: hour(1, 9), Started: hour(2, 9), Done: hour(3, 9)},
+		{Ref: "o/r#9", Added: hour(3, 9)},
+		{Ref: "o/r#10", Added: now.AddDate(0, 0, -30), Started: now.AddDate(0, 0, -25), Done: now.AddDate(0, 0, -20)},
+	}
+	d = buildDigest(digestWeekly, issues, flows, now, 7)
+	assert.Len(t, d.DoneInWeek, 1)
+	assert.Len(t, d.AddedInWeek, 2)
+	markdown, err = d.markdown()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(markdown, "## 看板周报 2018-12-04"))
+	assert.Contains(t, markdown, "### 本周完成\n- o/r#8 周期 1.0d\n")
+	html, err := d.html()
+	assert.Nil(t, err)
+	assert.Contains(t, html, "<li>o/r#8 周期 1.0d</li>")
+}
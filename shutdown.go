@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// waitForShutdown blocks until SIGTERM or SIGINT, then shuts down within
+// the timeout. A second signal exits immediately.
+func waitForShutdown(server *http.Server, timeout time.Duration) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	logrus.Infof("received %v, shutting down", sig)
+
+	go func() {
+		sig := <-ch
+		logrus.Fatalf("received %v again, exit now", sig)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdown(ctx, server)
+}
+
+// shutdown stops taking the webhooks and waits for the handlers, then stops
+// processing the webhook queue, waits for the running jobs and the queued
+// issue tasks, gives up the leadership, and closes the db at last so no work
+// is cut between a Github call and the db update. If it gives up waiting,
+// the lease is left to expire and the db is left open for the work still
+// running, so the next leader doesn't overlap with it.
+func shutdown(ctx context.Context, server *http.Server) {
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logrus.Warning("failed to shut down the http server: ", err)
+	}
+
+	finished := true
+	err = queueWorker.Stop(ctx)
+	if err != nil {
+		finished = false
+		logrus.Warning("gave up waiting for the webhook being processed: ", err)
+	}
+	err = scheduler.Stop(ctx)
+	if err != nil {
+		finished = false
+		logrus.Warning("gave up waiting for the running jobs: ", err)
+	}
+
+	err = issueExecutor.Drain(ctx)
+	if err != nil {
+		finished = false
+		logrus.Warningf("gave up waiting for %d issue tasks: %v", issueExecutor.Pending(), err)
+	}
+
+	if !finished {
+		elector.Abandon()
+		logrus.Warning("shut down with work still running, the leader lease is left to expire")
+		return
+	}
+
+	// release the lease after the work is done, so the next leader doesn't
+	// overlap with it.
+	elector.Stop()
+
+	err = db.Close()
+	if err != nil {
+		logrus.Warning("failed to close the db: ", err)
+	}
+	logrus.Info("shut down")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialect is the differences between the SQL databases the bot stores the
+// deadlines, history and queues in. The queries are written for SQLite with
+// ? as the placeholder and translated by the dialect.
+type dialect interface {
+	// driver is the name of the database/sql driver.
+	driver() string
+	// rebind replaces the ? placeholders in the query.
+	rebind(query string) string
+	// ddl translates the CREATE TABLE statement.
+	ddl(stmt string) string
+	// lockTable returns the statement locking the table until the end of
+	// the transaction, empty if the database doesn't need it.
+	lockTable(table string) string
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) driver() string             { return "sqlite3" }
+func (sqliteDialect) rebind(query string) string { return query }
+func (sqliteDialect) ddl(stmt string) string     { return stmt }
+
+// lockTable isn't needed for SQLite, which has a single writer.
+func (sqliteDialect) lockTable(table string) string { return "" }
+
+type postgresDialect struct{}
+
+func (postgresDialect) driver() string { return "postgres" }
+
+// rebind replaces the placeholders with $1, $2 and so on, the ones in the
+// string literals are kept.
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	// the deadlines are plain dates, which are DATE in both.
+	"DATETIME", "TIMESTAMPTZ",
+)
+
+func (postgresDialect) ddl(stmt string) string {
+	return postgresTypes.Replace(stmt)
+}
+
+func (postgresDialect) lockTable(table string) string {
+	return "LOCK TABLE " + table + " IN EXCLUSIVE MODE"
+}
+
+// storage is the database of the bot. The queries go through the dialect,
+// so the rest of the bot doesn't care which database it is.
+type storage struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (s *storage) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.DB.Exec(s.dialect.rebind(query), args...)
+}
+
+func (s *storage) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.DB.Query(s.dialect.rebind(query), args...)
+}
+
+func (s *storage) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.DB.QueryRow(s.dialect.rebind(query), args...)
+}
+
+// Begin starts a transaction whose queries go through the dialect too.
+func (s *storage) Begin() (*storageTx, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &storageTx{Tx: tx, dialect: s.dialect}, nil
+}
+
+type storageTx struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (tx *storageTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *storageTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *storageTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+// querier is either the database or a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var db *storage
+
+// sqliteBusyTimeout is how long a write waits for the lock of the SQLite
+// file held by another process, e.g. the subcommands run beside the bot.
+const sqliteBusyTimeout = 10 * time.Second
+
+// parseDSN returns the dialect and the data source of the DSN, which is a
+// postgres:// URL for PostgreSQL, otherwise the path of the SQLite file.
+func parseDSN(dsn string) (dialect, string) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect{}, dsn
+	}
+	return sqliteDialect{}, sqliteDataSource(strings.TrimPrefix(dsn, "sqlite3://"))
+}
+
+// sqliteDataSource adds the busy timeout to the SQLite data source, and
+// makes the transactions take the write lock when they begin, so they wait
+// for the other writers instead of failing with "database is locked" when
+// they start to write. The options given in the DSN are kept.
+func sqliteDataSource(dataSource string) string {
+	if dataSource == ":memory:" {
+		return dataSource
+	}
+	path, query := dataSource, ""
+	if i := strings.IndexByte(dataSource, '?'); i >= 0 {
+		path, query = dataSource[:i], dataSource[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return dataSource
+	}
+	if params.Get("_busy_timeout") == "" && params.Get("_timeout") == "" {
+		params.Set("_busy_timeout", strconv.Itoa(int(sqliteBusyTimeout/time.Millisecond)))
+	}
+	if params.Get("_txlock") == "" {
+		params.Set("_txlock", "immediate")
+	}
+	return path + "?" + params.Encode()
+}
+
+// openDB opens the database of the DSN without touching the schema.
+func openDB(dsn string) error {
+	d, dataSource := parseDSN(dsn)
+	sqlDB, err := sql.Open(d.driver(), dataSource)
+	if err != nil {
+		return err
+	}
+	if dataSource == ":memory:" {
+		// every connection has its own in-memory database.
+		sqlDB.SetMaxOpenConns(1)
+	}
+	db = &storage{DB: sqlDB, dialect: d}
+	return nil
+}
+
+// initDB opens the database of the DSN and migrates it to the latest schema.
+func initDB(dsn string) error {
+	err := openDB(dsn)
+	if err != nil {
+		return err
+	}
+	return migrateDB()
+}
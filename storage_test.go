@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialect(t *testing.T) {
+	d, dataSource := parseDSN("postgres://bot@localhost/kanbanmgr?sslmode=disable")
+	assert.Equal(t, "postgres", d.driver())
+	assert.Equal(t, "postgres://bot@localhost/kanbanmgr?sslmode=disable", dataSource)
+	assert.Equal(t, "SELECT id FROM issue_deadline WHERE url = $1 AND directive <> '?' AND date < $2",
+		d.rebind("SELECT id FROM issue_deadline WHERE url = ? AND directive <> '?' AND date < ?"))
+	assert.Equal(t, "id BIGSERIAL PRIMARY KEY, card_id BIGINT NOT NULL, moved_at TIMESTAMPTZ, date DATE",
+		d.ddl("id INTEGER PRIMARY KEY AUTOINCREMENT, card_id INTEGER NOT NULL, moved_at DATETIME, date DATE"))
+
+	d, dataSource = parseDSN("/var/lib/kanbanmgr/kanbanmgr.db")
+	assert.Equal(t, "sqlite3", d.driver())
+	assert.Equal(t, "/var/lib/kanbanmgr/kanbanmgr.db?_busy_timeout=10000&_txlock=immediate", dataSource)
+	_, dataSource = parseDSN("sqlite3:///tmp/kanbanmgr.db?_busy_timeout=500")
+	assert.Equal(t, "/tmp/kanbanmgr.db?_busy_timeout=500&_txlock=immediate", dataSource)
+	_, dataSource = parseDSN(":memory:")
+	assert.Equal(t, ":memory:", dataSource)
+	assert.Equal(t, "SELECT 1 WHERE ? = ?", d.rebind("SELECT 1 WHERE ? = ?"))
+}
+
+func TestStorageUpsert(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	recorded, err := recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.True(t, recorded)
+	recorded, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.False(t, recorded)
+
+	start := time.Date(2018, 12, 3, 1, 0, 0, 0, time.UTC)
+	assert.Nil(t, recordJobRun("delay-check", start, time.Second, nil))
+	assert.Nil(t, recordJobRun("delay-check", start.AddDate(0, 0, 1), time.Second, nil))
+	lastRun, err := getJobLastRun("delay-check")
+	assert.Nil(t, err)
+	assert.True(t, start.AddDate(0, 0, 1).Equal(lastRun))
+}
+
+func TestSQLiteConcurrentWriters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kanbanmgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dsn := filepath.Join(dir, "kanbanmgr.db")
+	assert.Nil(t, initDB(dsn))
+	defer db.Close()
+
+	// another process, e.g. the deadlines subcommand, holding the write lock
+	// for a while.
+	_, dataSource := parseDSN(dsn)
+	other, err := sql.Open("sqlite3", dataSource)
+	assert.Nil(t, err)
+	defer other.Close()
+	tx, err := other.Begin()
+	assert.Nil(t, err)
+	_, err = tx.Exec(`INSERT INTO job_run (name,last_run,duration_ms,error) VALUES ('other',?,0,'')`, time.Now())
+	assert.Nil(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		tx.Commit()
+	}()
+
+	assert.Nil(t, recordJobRun("delay-check", time.Now(), time.Second, nil))
+}
+
+// TestPostgresStorage runs the queries against the PostgreSQL database of
+// KANBANMGR_TEST_POSTGRES, in a schema created for the test and dropped
+// after it.
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv("KANBANMGR_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("KANBANMGR_TEST_POSTGRES is not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	assert.Nil(t, err)
+	defer admin.Close()
+	schema := fmt.Sprintf("kanbanmgr_test_%d", os.Getpid())
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	assert.Nil(t, err)
+	defer admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	assert.Nil(t, initDB(dsn+sep+"search_path="+schema))
+	defer db.Close()
+	_, ok := db.dialect.(postgresDialect)
+	assert.True(t, ok)
+	version, err := getSchemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, latestSchemaVersion(), version)
+	// migrating again changes nothing.
+	assert.Nil(t, migrateDB())
+
+	const issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	date := time.Date(2018, 12, 3, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, addIssueDeadline(&IssueDeadline{id: 1001, date: date, url: issueURL, directive: "<12-03>"}))
+	issueDeadline, err := getIssueDeadlineByURL(issueURL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1001), issueDeadline.id)
+	assert.Equal(t, "2018-12-03", formatDate(issueDeadline.date))
+
+	recorded, err := recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.True(t, recorded)
+	recorded, err = recordDelivery(db, "d1", "issues")
+	assert.Nil(t, err)
+	assert.False(t, recorded)
+
+	start := time.Date(2018, 12, 3, 1, 0, 0, 0, time.UTC)
+	assert.Nil(t, recordJobRun("delay-check", start, time.Second, nil))
+	assert.Nil(t, recordJobRun("delay-check", start.AddDate(0, 0, 1), time.Second, nil))
+	lastRun, err := getJobLastRun("delay-check")
+	assert.Nil(t, err)
+	assert.True(t, start.AddDate(0, 0, 1).Equal(lastRun))
+
+	now := time.Now()
+	e1 := &leaderElector{id: "a", lease: 30 * time.Second}
+	e2 := &leaderElector{id: "b", lease: 30 * time.Second}
+	leader, err := e1.tryAcquire(now)
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	leader, err = e2.tryAcquire(now)
+	assert.Nil(t, err)
+	assert.False(t, leader)
+	leader, err = e2.tryAcquire(now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, leader)
+}
@@ -17,21 +17,20 @@ var (
 	teamsLock sync.Mutex
 )
 
-func updateTeams() (err error) {
+func getTeams(org string) ([]*team, error) {
 	ctx := context.Background()
 	opts := &github.ListOptions{}
 
-	// clear the teams
-	metaTeams = []*team{}
+	ret := []*team{}
 
 	for {
-		teams, resp, err := client.Teams.ListTeams(ctx, OrgName, opts)
+		teams, resp, err := client.Teams.ListTeams(ctx, org, opts)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		for _, t := range teams {
-			metaTeams = append(metaTeams, &team{t, []*github.User{}})
+			ret = append(ret, &team{t, []*github.User{}})
 		}
 
 		if resp.NextPage == 0 {
@@ -40,7 +39,7 @@ func updateTeams() (err error) {
 		opts.Page = resp.NextPage
 	}
 
-	return nil
+	return ret, nil
 }
 
 func updateTeamMembers(team *team) (err error) {
@@ -64,22 +63,34 @@ func updateTeamMembers(team *team) (err error) {
 	return nil
 }
 
-// UpdateTeamsMetadata updates the metaTeams of all teams.
-func UpdateTeamsMetadata() error {
-	teamsLock.Lock()
-	defer teamsLock.Unlock()
-
-	err := updateTeams()
+// fetchTeamsMetadata fetches all the teams of the organization configured
+// in c with their members.
+func fetchTeamsMetadata(c *Config) ([]*team, error) {
+	teams, err := getTeams(c.Org)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, t := range metaTeams {
+	for _, t := range teams {
 		err := updateTeamMembers(t)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	return teams, nil
+}
+
+// UpdateTeamsMetadata updates the metaTeams of all teams.
+func UpdateTeamsMetadata() error {
+	teams, err := fetchTeamsMetadata(config())
+	if err != nil {
+		return err
+	}
+
+	teamsLock.Lock()
+	metaTeams = teams
+	teamsLock.Unlock()
 
+	markTeamsLoaded()
 	return nil
 }
 
@@ -89,7 +100,7 @@ func CheckUserMemeberOfQATeam(loginName string) bool {
 	defer teamsLock.Unlock()
 
 	for _, t := range metaTeams {
-		if t.GetName() == QATeamName {
+		if t.GetName() == config().Teams.QA {
 			for _, m := range t.Members {
 				if m.GetLogin() == loginName {
 					return true
@@ -106,7 +117,7 @@ func CheckUserMemeberOfDevTeam(loginName string) bool {
 	defer teamsLock.Unlock()
 
 	for _, t := range metaTeams {
-		if t.GetName() == DevTeamName {
+		if t.GetName() == config().Teams.Dev {
 			for _, m := range t.Members {
 				if m.GetLogin() == loginName {
 					return true
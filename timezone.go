@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+const layoutClock = "15:04"
+
+var (
+	locations     = make(map[string]*time.Location)
+	locationsLock sync.Mutex
+)
+
+// loadLocation is time.LoadLocation with the result cached.
+func loadLocation(name string) (*time.Location, error) {
+	locationsLock.Lock()
+	defer locationsLock.Unlock()
+
+	loc, ok := locations[name]
+	if ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// boardLocation returns the location of the board timezone, the timezone
+// is checked when the config is validated.
+func (c *Config) boardLocation() *time.Location {
+	loc, err := loadLocation(c.Board.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// issueTimezone returns the timezone of the first assignee which has one
+// configured, or empty for the board timezone.
+func (c *Config) issueTimezone(issue *github.Issue) string {
+	for _, assignee := range issue.Assignees {
+		name, ok := c.Board.AssigneeTimezones[assignee.GetLogin()]
+		if !ok {
+			continue
+		}
+		if _, err := loadLocation(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// issueLocation returns the location of the timezone of the issue, see
+// issueTimezone.
+func (c *Config) issueLocation(issue *github.Issue) *time.Location {
+	return c.timezoneLocation(c.issueTimezone(issue))
+}
+
+// timezoneLocation returns the location of the timezone, empty or unknown
+// ones fall back to the board timezone.
+func (c *Config) timezoneLocation(name string) *time.Location {
+	if name == "" {
+		return c.boardLocation()
+	}
+	loc, err := loadLocation(name)
+	if err != nil {
+		return c.boardLocation()
+	}
+	return loc
+}
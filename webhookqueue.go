@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookQueueBatch is how many queued webhooks are loaded at a time.
+	webhookQueueBatch = 100
+	// webhookQueuePoll is how often the replicas look for the webhooks
+	// received by the others.
+	webhookQueuePoll = time.Second
+	// webhookQueueRetention is how long the processed webhooks are kept, so
+	// the replicas behind still apply them.
+	webhookQueueRetention = 24 * time.Hour
+)
+
+// queuedWebhook is a delivery accepted by any replica. Every replica applies
+// it to its own state, and the leader claims it, handles it and marks it
+// done.
+type queuedWebhook struct {
+	id       int64
+	delivery string
+	event    string
+	payload  string
+}
+
+// queueDelivery records the delivery and queues it in one transaction,
+// returns false if the delivery has been recorded, which means it's a
+// redelivery.
+func queueDelivery(deliveryID, event string, payload []byte) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if deliveryID != "" {
+		fresh, err := recordDelivery(tx, deliveryID, event)
+		if err != nil || !fresh {
+			return false, err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO webhook_queue (delivery,event,payload,received_at) VALUES (?,?,?,?)`,
+		deliveryID, event, string(payload), time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func scanQueuedWebhooks(rows *sql.Rows, err error) ([]*queuedWebhook, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ret []*queuedWebhook
+	for rows.Next() {
+		w := &queuedWebhook{}
+		err = rows.Scan(&w.id, &w.delivery, &w.event, &w.payload)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, w)
+	}
+	return ret, rows.Err()
+}
+
+// listQueuedWebhooks returns the webhooks queued after the one with the id,
+// done or not.
+func listQueuedWebhooks(after int64, limit int) ([]*queuedWebhook, error) {
+	return scanQueuedWebhooks(db.Query(`SELECT id,delivery,event,payload FROM webhook_queue
+		WHERE id > ? ORDER BY id LIMIT ?`, after, limit))
+}
+
+// listPendingWebhooks returns the webhooks not done yet, up to the one with
+// the id.
+func listPendingWebhooks(upTo int64, limit int) ([]*queuedWebhook, error) {
+	return scanQueuedWebhooks(db.Query(`SELECT id,delivery,event,payload FROM webhook_queue
+		WHERE done_at IS NULL AND id <= ? ORDER BY id LIMIT ?`, upTo, limit))
+}
+
+func lastQueuedWebhookID() (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM webhook_queue`).Scan(&id)
+	return id, err
+}
+
+// claimQueuedWebhook claims the webhook for the holder, returns false if
+// the holder no longer holds the leader lease, or the webhook is done. A new
+// leader claims the webhooks left by the old one again.
+func claimQueuedWebhook(id int64, holder string) (bool, error) {
+	res, err := db.Exec(`UPDATE webhook_queue SET claimed_by = ?
+		WHERE id = ? AND done_at IS NULL AND EXISTS (SELECT 1 FROM leader_lease
+			WHERE name = ? AND holder = ? AND expires_at > ?)`,
+		holder, id, leaseName, holder, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ackQueuedWebhook marks the webhook claimed by the holder done, returns
+// false if it has been claimed by another leader since.
+func ackQueuedWebhook(id int64, holder string) (bool, error) {
+	res, err := db.Exec(`UPDATE webhook_queue SET done_at = ?
+		WHERE id = ? AND claimed_by = ? AND done_at IS NULL`,
+		time.Now().UTC(), id, holder)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// countQueuedWebhooks returns the number of the webhooks not done yet.
+func countQueuedWebhooks() (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM webhook_queue WHERE done_at IS NULL`).Scan(&count)
+	return count, err
+}
+
+func pruneQueuedWebhooks(before time.Time) error {
+	_, err := db.Exec("DELETE FROM webhook_queue WHERE done_at < ?", before.UTC())
+	return err
+}
+
+func parseQueuedWebhook(w *queuedWebhook) (log *logrus.Entry, action string, event interface{}, err error) {
+	log = logrus.WithFields(logrus.Fields{"delivery": w.delivery, "event": w.event})
+	event, err = github.ParseWebHook(w.event, []byte(w.payload))
+	if err != nil {
+		return log, "", nil, err
+	}
+	if e, ok := event.(interface{ GetAction() string }); ok {
+		action = e.GetAction()
+		log = log.WithField("action", action)
+	}
+	return log, action, event, nil
+}
+
+// applyQueuedWebhooks applies the webhooks queued after the one with the id
+// to the state of this replica, returns the id of the last one applied.
+func applyQueuedWebhooks(after int64, stop <-chan struct{}) (int64, error) {
+	for {
+		webhooks, err := listQueuedWebhooks(after, webhookQueueBatch)
+		if err != nil || len(webhooks) == 0 {
+			return after, err
+		}
+
+		for _, w := range webhooks {
+			select {
+			case <-stop:
+				return after, nil
+			default:
+			}
+
+			log, action, event, err := parseQueuedWebhook(w)
+			if err != nil {
+				log.Errorf("parse webhook failed: %v", err)
+			} else {
+				applyWebhookEvent(log, action, event)
+			}
+			after = w.id
+		}
+	}
+}
+
+// processWebhookQueue handles the webhooks not done yet as the holder of the
+// leader lease, up to the one with the id. The leadership is checked before
+// each of them, and a webhook is only marked done after it's handled, so a
+// webhook cut by a handover is handled again by the next leader.
+func processWebhookQueue(holder string, upTo int64, stop <-chan struct{}) error {
+	for {
+		webhooks, err := listPendingWebhooks(upTo, webhookQueueBatch)
+		if err != nil || len(webhooks) == 0 {
+			return err
+		}
+
+		more, err := dispatchQueuedWebhooks(holder, webhooks, stop)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// dispatchQueuedWebhooks claims the webhooks and hands them to the
+// webhookExecutor keyed by their issues, each is marked done when its
+// handling returns. It waits for all of them before returning, so they aren't
+// listed again while being handled, and returns false if it stopped early.
+func dispatchQueuedWebhooks(holder string, webhooks []*queuedWebhook, stop <-chan struct{}) (bool, error) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for _, w := range webhooks {
+		select {
+		case <-stop:
+			return false, nil
+		default:
+		}
+		if !isLeader() {
+			return false, nil
+		}
+
+		claimed, err := claimQueuedWebhook(w.id, holder)
+		if err != nil {
+			return false, err
+		}
+		if !claimed {
+			// the lease is lost.
+			return false, nil
+		}
+
+		log, action, event, err := parseQueuedWebhook(w)
+		if err != nil {
+			log.Errorf("parse webhook failed: %v", err)
+			ackHandledWebhook(log, w, holder)
+			continue
+		}
+
+		w := w
+		wg.Add(1)
+		webhookExecutor.Submit(webhookKey(event), func() {
+			defer wg.Done()
+			// the lease was lost while waiting for the webhooks before.
+			if !isLeader() {
+				return
+			}
+			handleQueuedWebhook(log, w, action, event)
+			ackHandledWebhook(log, w, holder)
+		})
+	}
+	return true, nil
+}
+
+// webhookKey returns the url of the issue the event is about, empty for the
+// other events.
+func webhookKey(event interface{}) string {
+	switch event := event.(type) {
+	case *github.IssuesEvent:
+		return event.GetIssue().GetURL()
+	case *github.ProjectCardEvent:
+		return event.GetProjectCard().GetContentURL()
+	}
+	return ""
+}
+
+func ackHandledWebhook(log *logrus.Entry, w *queuedWebhook, holder string) {
+	acked, err := ackQueuedWebhook(w.id, holder)
+	if err != nil {
+		log.Warning("failed to mark the webhook done: ", err)
+	} else if !acked {
+		log.Warning("the webhook has been claimed by the next leader")
+	}
+}
+
+func processQueuedWebhook(w *queuedWebhook) {
+	log, action, event, err := parseQueuedWebhook(w)
+	if err != nil {
+		log.Errorf("parse webhook failed: %v", err)
+		return
+	}
+	handleQueuedWebhook(log, w, action, event)
+}
+
+func handleQueuedWebhook(log *logrus.Entry, w *queuedWebhook, action string, event interface{}) {
+	var result string
+	// a panic fails the webhook like an error, instead of handling it again
+	// and again.
+	err := protect(func() (err error) {
+		result, err = handleWebhookEvent(log, action, event)
+		return err
+	})
+	if err != nil {
+		log.Error("failed to handle the webhook: ", err)
+		result = webhookFailed
+		// the failed delivery is done, its redelivery is queued again.
+		if w.delivery != "" {
+			err = forgetDelivery(w.delivery)
+			if err != nil {
+				log.Warning("failed to forget the delivery: ", err)
+			}
+		}
+	}
+	webhookEvents.WithLabelValues(w.event, action, result).Inc()
+}
+
+// webhookWorker applies the webhook queue to the state of every replica,
+// and processes it on the leader. It's woken up by the webhooks received by
+// this replica, and polls for the ones received by the others.
+type webhookWorker struct {
+	// applied is the id of the last webhook applied by this replica.
+	applied int64
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+var queueWorker = &webhookWorker{
+	wake: make(chan struct{}, 1),
+	stop: make(chan struct{}),
+	done: make(chan struct{}),
+}
+
+// Start runs the worker. The webhooks queued before aren't applied, since
+// the metadata loaded at the start are newer than them, while the ones not
+// done are still handled by the leader.
+func (w *webhookWorker) Start() error {
+	applied, err := lastQueuedWebhookID()
+	if err != nil {
+		return err
+	}
+	w.applied = applied
+	go w.Run()
+	return nil
+}
+
+func (w *webhookWorker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes the queue until Stop, the webhooks wait in the queue until
+// the metadata are loaded, and are only handled by the leader.
+func (w *webhookWorker) Run() {
+	defer close(w.done)
+	ticker := time.NewTicker(webhookQueuePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.wake:
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+
+		if !isMetadataLoaded() {
+			continue
+		}
+		applied, err := applyQueuedWebhooks(w.applied, w.stop)
+		w.applied = applied
+		if err != nil {
+			logrus.Warning("failed to apply the webhook queue: ", err)
+			continue
+		}
+
+		if !isLeader() {
+			continue
+		}
+		err = processWebhookQueue(elector.id, w.applied, w.stop)
+		if err != nil {
+			logrus.Warning("failed to process the webhook queue: ", err)
+		}
+	}
+}
+
+// Stop stops processing the queue and waits for the webhook being processed
+// until ctx is done, the rest are left to the next leader.
+func (w *webhookWorker) Stop(ctx context.Context) error {
+	close(w.stop)
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookQueue(t *testing.T) {
+	assert.Nil(t, initDB(":memory:"))
+	defer db.Close()
+
+	fresh, err := queueDelivery("d1", "ping", []byte(`{"zen":"Keep it logically awesome."}`))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	// a redelivery isn't queued again.
+	fresh, err = queueDelivery("d1", "ping", []byte(`{"zen":"Keep it logically awesome."}`))
+	assert.Nil(t, err)
+	assert.False(t, fresh)
+	fresh, err = queueDelivery("d2", "ping", []byte(`{"zen":"Design for failure."}`))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	count, err := countQueuedWebhooks()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	applied, err := applyQueuedWebhooks(0, nil)
+	assert.Nil(t, err)
+	webhooks, err := listPendingWebhooks(applied, webhookQueueBatch)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, 2)
+	assert.Equal(t, "d1", webhooks[0].delivery)
+
+	// only the holder of the lease claims the webhooks.
+	claimed, err := claimQueuedWebhook(webhooks[0].id, "a")
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+	a := &leaderElector{id: "a", lease: 30 * time.Second}
+	leader, err := a.tryAcquire(time.Now())
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	claimed, err = claimQueuedWebhook(webhooks[0].id, "a")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	acked, err := ackQueuedWebhook(webhooks[0].id, "a")
+	assert.Nil(t, err)
+	assert.True(t, acked)
+	// a webhook is only done once.
+	claimed, err = claimQueuedWebhook(webhooks[0].id, "a")
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+
+	// b takes over while a is handling the webhook, which is handled again
+	// by b, and a can't mark it done.
+	claimed, err = claimQueuedWebhook(webhooks[1].id, "a")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	b := &leaderElector{id: "b", lease: 30 * time.Second}
+	leader, err = b.tryAcquire(time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, leader)
+	claimed, err = claimQueuedWebhook(webhooks[1].id, "b")
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	acked, err = ackQueuedWebhook(webhooks[1].id, "a")
+	assert.Nil(t, err)
+	assert.False(t, acked)
+	acked, err = ackQueuedWebhook(webhooks[1].id, "b")
+	assert.Nil(t, err)
+	assert.True(t, acked)
+
+	fresh, err = queueDelivery("d3", "ping", []byte(`{"zen":"Favor focus over features."}`))
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	applied, err = applyQueuedWebhooks(applied, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, processWebhookQueue("a", applied, nil))
+	count, err = countQueuedWebhooks()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Nil(t, processWebhookQueue("b", applied, nil))
+	count, err = countQueuedWebhooks()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// the done webhooks are kept for the replicas behind until pruned.
+	webhooks, err = listQueuedWebhooks(0, webhookQueueBatch)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, 3)
+	assert.Nil(t, pruneQueuedWebhooks(time.Now().Add(time.Hour)))
+	webhooks, err = listQueuedWebhooks(0, webhookQueueBatch)
+	assert.Nil(t, err)
+	assert.Len(t, webhooks, 0)
+}
+
+func TestWebhookKey(t *testing.T) {
+	const issueURL = "https://api.github.com/repos/linuxdeepin/dde/issues/1"
+	assert.Equal(t, issueURL, webhookKey(&github.IssuesEvent{Issue: &github.Issue{URL: github.String(issueURL)}}))
+	assert.Equal(t, issueURL, webhookKey(&github.ProjectCardEvent{
+		ProjectCard: &github.ProjectCard{ContentURL: github.String(issueURL)}}))
+	assert.Equal(t, "", webhookKey(&github.PingEvent{}))
+}